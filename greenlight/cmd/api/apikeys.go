@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/validator"
+	"net/http"
+	"time"
+)
+
+// The createAPIKeyHandler() creates an API key for the authenticated user. The key is
+// only included in this response, as just its hash is stored. Since a key outlives the
+// session it was created from, the user has to give their password again, and a second
+// factor if they have two-factor authentication turned on.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name          string   `json:"name"`
+		Permissions   []string `json:"permissions"`
+		ExpiresInDays *int     `json:"expires_in_days"`
+		Password      string   `json:"password"`
+		Code          string   `json:"code"`
+		RecoveryCode  string   `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// The user is read again, as the one in the request context may have come from a
+	// JWT and so not have a password hash.
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	expiresInDays := data.DefaultAPIKeyTTLDays
+	if input.ExpiresInDays != nil {
+		expiresInDays = *input.ExpiresInDays
+	}
+
+	key := &data.APIKey{
+		UserID:      user.ID,
+		Name:        input.Name,
+		Permissions: input.Permissions,
+		ExpiresAt:   time.Now().AddDate(0, 0, expiresInDays),
+	}
+
+	v := validator.New()
+	data.ValidateAPIKey(v, key)
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.reauthenticate(w, r, user, input.Password, input.Code, input.RecoveryCode) {
+		return
+	}
+
+	err = app.models.APIKeys.Insert(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidPermission):
+			v.AddError("permissions", "must only contain permissions your account has")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The reauthenticate() method checks the password, and the second factor if the user
+// has two-factor authentication turned on, of a user who is already authenticated, and
+// sends an error response if they're wrong. Wrong guesses count as failed logins, so
+// that a stolen authentication token can't be used to guess the password.
+func (app *application) reauthenticate(w http.ResponseWriter, r *http.Request, user *data.User, password, code, recoveryCode string) bool {
+	throttleKeys, err := app.loginThrottleKeys(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	throttles, retryAfter, err := app.reserveLoginAttempt(throttleKeys)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return false
+	}
+
+	v := validator.New()
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if match {
+		totpEnabled, err := app.models.TOTP.Enabled(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		if totpEnabled {
+			if validateSecondFactor(v, code, recoveryCode); !v.Valid() {
+				// A missing code isn't a guess, so the attempt is handed back.
+				err = app.releaseLoginAttempt(throttleKeys)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return false
+				}
+				app.failedValidationResponse(w, r, v.Errors)
+				return false
+			}
+
+			match, err = app.checkSecondFactor(user.ID, code, recoveryCode)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return false
+			}
+
+			if !match {
+				v.AddError("code", "is not valid")
+			}
+		}
+	} else {
+		v.AddError("password", "is not correct")
+	}
+
+	if !v.Valid() {
+		app.loginFailed(throttleKeys, throttles, user)
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	err = app.loginSucceeded(throttleKeys)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	return true
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.APIKeys.Delete(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "API key successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/storage"
+	"greenlight.dimash.net/internal/thumbnail"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The largest width and height of a generated thumbnail, in pixels.
+const thumbnailSize = 256
+
+// The number of thumbnails which can be generated at once. Each holds a whole decoded
+// image in memory, so this bounds the memory used by concurrent uploads.
+const maxConcurrentThumbnails = 2
+
+// The content types which can be uploaded as attachments, as detected from the file
+// contents rather than trusted from the client. The boolean reports whether a thumbnail
+// can be generated for the type.
+var attachmentContentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      false,
+	"application/pdf": false,
+	"text/plain":      false,
+}
+
+var (
+	errMissingFile     = errors.New(`body must contain a "file" part`)
+	errAttachmentEmpty = errors.New("file must not be empty")
+)
+
+// The readCraftingMaterialForAttachment() helper reads the crafting material id from the
+// URL and checks that it exists, sending a 404 response and returning false if not.
+func (app *application) readCraftingMaterialForAttachment(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return 0, false
+	}
+
+	_, err = app.models.CraftingMaterials.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return 0, false
+	}
+
+	return id, true
+}
+
+// The readAttachment() helper looks up the attachment named by the URL, sending a 404
+// response and returning nil if the crafting material or the attachment doesn't exist.
+func (app *application) readAttachment(w http.ResponseWriter, r *http.Request) *data.Attachment {
+	materialID, ok := app.readCraftingMaterialForAttachment(w, r)
+	if !ok {
+		return nil
+	}
+
+	id, err := app.readInt64Param(r, "attachment_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	attachment, err := app.models.Attachments.Get(materialID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return attachment
+}
+
+// The uploadAttachmentHandler() accepts a multipart/form-data body with the file in a
+// part named "file". The body is streamed straight to storage instead of being buffered
+// by ParseMultipartForm(), and is limited by the attachments-max-size setting rather
+// than the 1MB cap used for JSON bodies.
+func (app *application) uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	materialID, ok := app.readCraftingMaterialForAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	maxSize := app.config.attachments.maxSize
+
+	// Allow some room on top of the file for the multipart boundaries and headers.
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+64*1024)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var part io.ReadCloser
+	var filename string
+
+	for {
+		p, err := reader.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				app.badRequestResponse(w, r, errMissingFile)
+			} else {
+				app.attachmentReadErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if p.FormName() == "file" {
+			part, filename = p, p.FileName()
+			break
+		}
+		p.Close()
+	}
+	defer part.Close()
+
+	filename = filepath.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if filename == "." || filename == "/" || filename == "" {
+		filename = "attachment"
+	}
+	if len(filename) > 255 {
+		filename = filename[:255]
+	}
+
+	// Sniff the content type from the first 512 bytes, which is all that
+	// http.DetectContentType() looks at.
+	br := bufio.NewReaderSize(part, 512)
+	head, err := br.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		app.attachmentReadErrorResponse(w, r, err)
+		return
+	}
+	if len(head) == 0 {
+		app.badRequestResponse(w, r, errAttachmentEmpty)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	thumbnailable, allowed := attachmentContentTypes[contentType]
+	if !allowed {
+		app.errorResponse(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("files of type %s are not supported", contentType))
+		return
+	}
+
+	key, err := newAttachmentKey(materialID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Read one byte more than the limit, so that an oversized file can be told apart
+	// from one which is exactly the maximum size.
+	body := &errorRecordingReader{r: io.LimitReader(br, maxSize+1)}
+	size, err := app.storage.Put(key, body)
+	if err != nil {
+		app.storage.Delete(key)
+		// Errors reading the request body are the client's, anything else is ours.
+		if body.err != nil {
+			app.attachmentReadErrorResponse(w, r, body.err)
+		} else {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if size > maxSize {
+		app.storage.Delete(key)
+		app.attachmentTooLargeResponse(w, r)
+		return
+	}
+
+	attachment := &data.Attachment{
+		CraftingMaterialID: materialID,
+		Filename:           filename,
+		ContentType:        contentType,
+		Size:               size,
+		StorageKey:         key,
+	}
+
+	if thumbnailable {
+		attachment.ThumbnailKey = app.generateThumbnail(r, key)
+	}
+
+	err = app.models.Attachments.Insert(attachment)
+	if err != nil {
+		app.deleteAttachmentFiles(r, attachment)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/crafting_materials/%d/attachments/%d", materialID, attachment.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"attachment": attachment}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The generateThumbnail() helper creates a thumbnail for the image stored under key and
+// returns the key of the thumbnail. Images which can't be thumbnailed are still
+// accepted, so failures are only logged and nil is returned.
+func (app *application) generateThumbnail(r *http.Request, key string) *string {
+	src, err := app.storage.Open(key)
+	if err != nil {
+		app.logError(r, err)
+		return nil
+	}
+	defer src.Close()
+
+	// Wait for a free slot, or give up on the thumbnail if the client goes away first.
+	select {
+	case app.thumbnailSlots <- struct{}{}:
+		defer func() { <-app.thumbnailSlots }()
+	case <-r.Context().Done():
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err = thumbnail.Generate(&buf, src, thumbnailSize)
+	if err != nil {
+		app.logError(r, err)
+		return nil
+	}
+
+	thumbnailKey := key + ".thumb.png"
+	_, err = app.storage.Put(thumbnailKey, &buf)
+	if err != nil {
+		app.logError(r, err)
+		return nil
+	}
+
+	return &thumbnailKey
+}
+
+func (app *application) listAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	materialID, ok := app.readCraftingMaterialForAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	attachments, err := app.models.Attachments.GetAllForCraftingMaterial(materialID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"attachments": attachments}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) downloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	attachment := app.readAttachment(w, r)
+	if attachment == nil {
+		return
+	}
+
+	// Images are shown inline, everything else is downloaded.
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = "inline"
+	}
+
+	app.serveAttachmentFile(w, r, attachment.StorageKey, attachment.ContentType, attachment.Size,
+		mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+}
+
+func (app *application) downloadAttachmentThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	attachment := app.readAttachment(w, r)
+	if attachment == nil {
+		return
+	}
+
+	if attachment.ThumbnailKey == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.serveAttachmentFile(w, r, *attachment.ThumbnailKey, "image/png", -1, "inline")
+}
+
+// The serveAttachmentFile() helper streams a file from storage. A size of -1 means the
+// size isn't known and no Content-Length header is sent.
+func (app *application) serveAttachmentFile(w http.ResponseWriter, r *http.Request, key, contentType string, size int64, disposition string) {
+	file, err := app.storage.Open(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	// Once the body has started the status code has been sent, so errors can only be
+	// logged.
+	_, err = io.Copy(w, file)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func (app *application) deleteAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	materialID, ok := app.readCraftingMaterialForAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := app.readInt64Param(r, "attachment_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	attachment, err := app.models.Attachments.Delete(materialID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.deleteAttachmentFiles(r, attachment)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "attachment successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAttachmentFiles() helper removes an attachment's files from storage. The
+// record is already gone by this point, so failures are only logged.
+func (app *application) deleteAttachmentFiles(r *http.Request, attachment *data.Attachment) {
+	keys := []string{attachment.StorageKey}
+	if attachment.ThumbnailKey != nil {
+		keys = append(keys, *attachment.ThumbnailKey)
+	}
+
+	for _, key := range keys {
+		err := app.storage.Delete(key)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+}
+
+// The attachmentReadErrorResponse() method reports an error reading the upload body,
+// which is either the client exceeding the size limit or a malformed body.
+func (app *application) attachmentReadErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		app.attachmentTooLargeResponse(w, r)
+		return
+	}
+
+	app.badRequestResponse(w, r, err)
+}
+
+func (app *application) attachmentTooLargeResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("file must not be larger than %d bytes", app.config.attachments.maxSize)
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, message)
+}
+
+// errorRecordingReader remembers the first error other than io.EOF returned by the
+// reader it wraps.
+type errorRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// newAttachmentKey returns a new random storage key for a file attached to the given
+// crafting material.
+func newAttachmentKey(materialID int64) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("attachments/%d/%s", materialID, hex.EncodeToString(b)), nil
+}
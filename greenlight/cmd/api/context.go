@@ -8,7 +8,12 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey      = contextKey("user")
+	tokenContextKey     = contextKey("token")
+	sessionIDContextKey = contextKey("sessionID")
+	apiKeyIDContextKey  = contextKey("apiKeyID")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +28,45 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetToken() method stores the plaintext authentication token the request
+// was made with, so that handlers can act on the current session.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() method returns the plaintext authentication token the request
+// was made with, or "" for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// The contextSetSessionID() method stores the id of the session a JWT access token was
+// issued for. Opaque tokens are matched to their session in the database instead.
+func (app *application) contextSetSessionID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetSessionID() method returns the session id stored by
+// contextSetSessionID(), or 0 if there isn't one.
+func (app *application) contextGetSessionID(r *http.Request) int64 {
+	id, _ := r.Context().Value(sessionIDContextKey).(int64)
+	return id
+}
+
+// The contextSetAPIKeyID() method stores the id of the API key the request was
+// authenticated with.
+func (app *application) contextSetAPIKeyID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKeyID() method returns the id of the API key the request was
+// authenticated with, or 0 if it wasn't made with one.
+func (app *application) contextGetAPIKeyID(r *http.Request) int64 {
+	id, _ := r.Context().Value(apiKeyIDContextKey).(int64)
+	return id
+}
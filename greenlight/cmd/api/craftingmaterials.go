@@ -4,8 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/rates"
 	"greenlight.dimash.net/internal/validator"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
 //	for the "POST /v1/crafting_materials" endpoint. For now we simply
@@ -13,9 +17,11 @@ import (
 // return a plain-text placeholder response.
 func (app *application) createCraftingMaterialHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title string     `json:"title"`
-		Year  int32      `json:"year"`
-		Price data.Price `json:"price"`
+		Title      string     `json:"title"`
+		Year       int32      `json:"year"`
+		Price      data.Price `json:"price"`
+		CategoryID *int64     `json:"category_id"`
+		Tags       []string   `json:"tags"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -25,9 +31,11 @@ func (app *application) createCraftingMaterialHandler(w http.ResponseWriter, r *
 	}
 
 	craftingMaterial := &data.CraftingMaterials{
-		Title: input.Title,
-		Year:  input.Year,
-		Price: input.Price,
+		Title:      input.Title,
+		Year:       input.Year,
+		Price:      input.Price,
+		CategoryID: input.CategoryID,
+		Tags:       data.NormalizeTags(input.Tags),
 	}
 
 	// Initialize a new Validator instance.
@@ -38,9 +46,15 @@ func (app *application) createCraftingMaterialHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	err = app.models.CraftingMaterials.Insert(craftingMaterial)
+	err = app.models.CraftingMaterials.Insert(craftingMaterial, app.contextGetUser(r).ID)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrInvalidCategory):
+			v.AddError("category_id", "must be an existing category")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -64,7 +78,23 @@ func (app *application) showCraftingMaterialHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	craftingMaterial, err := app.models.CraftingMaterials.Get(id)
+	v := validator.New()
+	includeDeleted := app.readBool(r.URL.Query(), "include_deleted", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkIncludeDeleted(w, r, includeDeleted) {
+		return
+	}
+
+	var craftingMaterial *data.CraftingMaterials
+	if includeDeleted {
+		craftingMaterial, err = app.models.CraftingMaterials.GetIncludingDeleted(id)
+	} else {
+		craftingMaterial, err = app.models.CraftingMaterials.Get(id)
+	}
 
 	if err != nil {
 		switch {
@@ -77,7 +107,17 @@ func (app *application) showCraftingMaterialHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"crafting_materials": craftingMaterial}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", etag(craftingMaterial.Version))
+
+	// If the client already holds the current version, tell it to use its cached copy.
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && matchesETag(ifNoneMatch, etag(craftingMaterial.Version), true) {
+		w.Header().Set("ETag", etag(craftingMaterial.Version))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"crafting_materials": craftingMaterial}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -103,10 +143,18 @@ func (app *application) updateCraftingMaterialHandler(w http.ResponseWriter, r *
 		return
 	}
 
+	if !app.checkIfMatch(w, r, craftingMaterial.Version) {
+		return
+	}
+
+	// A category_id of 0 removes the crafting material from its category, and a
+	// tags array replaces all of its tags.
 	var input struct {
-		Title *string     `json:"title"`
-		Year  *int32      `json:"year"`
-		Price *data.Price `json:"price"`
+		Title      *string     `json:"title"`
+		Year       *int32      `json:"year"`
+		Price      *data.Price `json:"price"`
+		CategoryID *int64      `json:"category_id"`
+		Tags       []string    `json:"tags"`
 	}
 
 	err = app.readJSON(w, r, &input)
@@ -115,6 +163,8 @@ func (app *application) updateCraftingMaterialHandler(w http.ResponseWriter, r *
 		return
 	}
 
+	oldValues := craftingMaterial.Snapshot()
+
 	if input.Year != nil {
 		craftingMaterial.Year = *input.Year
 	}
@@ -124,6 +174,15 @@ func (app *application) updateCraftingMaterialHandler(w http.ResponseWriter, r *
 	if input.Price != nil {
 		craftingMaterial.Price = *input.Price
 	}
+	if input.CategoryID != nil {
+		craftingMaterial.CategoryID = input.CategoryID
+		if *input.CategoryID == 0 {
+			craftingMaterial.CategoryID = nil
+		}
+	}
+	if input.Tags != nil {
+		craftingMaterial.Tags = data.NormalizeTags(input.Tags)
+	}
 
 	v := validator.New()
 	data.ValidateCraftingMaterial(v, craftingMaterial)
@@ -132,9 +191,16 @@ func (app *application) updateCraftingMaterialHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	err = app.models.CraftingMaterials.Update(craftingMaterial)
+	err = app.models.CraftingMaterials.Update(craftingMaterial, oldValues, data.HistoryActionUpdate, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrInvalidCategory):
+			v.AddError("category_id", "must be an existing category")
+			app.failedValidationResponse(w, r, v.Errors)
+		// A client which sent If-Match asked for the update to be conditional, so a
+		// concurrent change is reported as a failed precondition.
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -143,7 +209,10 @@ func (app *application) updateCraftingMaterialHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"crafting_materials": craftingMaterial}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", etag(craftingMaterial.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"crafting_materials": craftingMaterial}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -156,7 +225,9 @@ func (app *application) deleteCraftingMaterialHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	err = app.models.CraftingMaterials.Delete(id)
+	// Fetch the crafting material first so that If-Match can be checked against it. The
+	// delete only goes ahead if it is still at the same version.
+	craftingMaterial, err := app.models.CraftingMaterials.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -168,41 +239,174 @@ func (app *application) deleteCraftingMaterialHandler(w http.ResponseWriter, r *
 		return
 	}
 
+	if !app.checkIfMatch(w, r, craftingMaterial.Version) {
+		return
+	}
+
+	err = app.models.CraftingMaterials.Delete(id, craftingMaterial.Version, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrCraftingMaterialInUse):
+			app.errorResponse(w, r, http.StatusConflict, "the crafting material is used by a recipe")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "crafting material successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+var craftingMaterialsSortSafelist = []string{"id", "title", "year", "price", "rank", "-id", "-title", "-year", "-price"}
+
+// The readCraftingMaterialSearch() helper reads the search and range filter parameters
+// shared by the list and export endpoints from the query string.
+func (app *application) readCraftingMaterialSearch(qs url.Values, v *validator.Validator) data.CraftingMaterialSearch {
+	search := data.CraftingMaterialSearch{
+		Title:         app.readString(qs, "title", ""),
+		SearchMode:    app.readString(qs, "search_mode", data.SearchModeFullText),
+		PriceCurrency: strings.ToUpper(app.readString(qs, "price_currency", "")),
+		YearFrom:      app.readInt(qs, "year_from", 0, v),
+		YearTo:        app.readInt(qs, "year_to", 0, v),
+
+		IncludeDeleted: app.readBool(qs, "include_deleted", false, v),
+
+		CategoryID: int64(app.readInt(qs, "category", 0, v)),
+		Tags:       data.NormalizeTags(app.readCSV(qs, "tags", []string{})),
+	}
+
+	// Price bounds only make sense within a single currency, so they are compared in
+	// price_currency, which has to be given along with them.
+	if search.PriceCurrency == "" && (qs.Get("min_price") != "" || qs.Get("max_price") != "") {
+		v.AddError("price_currency", "must be provided to filter by price")
+	}
+	search.MinPrice = app.readAmount(qs, "min_price", search.PriceCurrency, v)
+	search.MaxPrice = app.readAmount(qs, "max_price", search.PriceCurrency, v)
+
+	return search
+}
+
+// The checkIncludeDeleted() helper sends a 403 response and returns false if the
+// request asks for soft deleted crafting materials without the admin permission.
+func (app *application) checkIncludeDeleted(w http.ResponseWriter, r *http.Request, includeDeleted bool) bool {
+	if !includeDeleted {
+		return true
+	}
+
+	ok, err := app.userHasPermission(r, "craftingmaterials:admin")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+func (app *application) restoreCraftingMaterialHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	craftingMaterial, err := app.models.CraftingMaterials.Restore(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"crafting_material": craftingMaterial}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) listCraftingMaterialsHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title string
+		Currency string
+		data.CraftingMaterialSearch
 		data.Filters
 	}
 	v := validator.New()
 
 	qs := r.URL.Query()
 
-	input.Title = app.readString(qs, "title", "")
+	input.Currency = strings.ToUpper(app.readString(qs, "currency", ""))
+	input.CraftingMaterialSearch = app.readCraftingMaterialSearch(qs, v)
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
+	// The presence of the cursor parameter (even with an empty value for the first
+	// page) switches the listing into keyset pagination mode.
+	_, input.Filters.Keyset = qs["cursor"]
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "year", "price", "-id", "-title", "-year", "-price"}
+	input.Filters.SortSafelist = craftingMaterialsSortSafelist
+
+	data.ValidateCraftingMaterialSearch(v, input.CraftingMaterialSearch)
+	data.ValidateCraftingMaterialSort(v, input.Filters.Sort, input.CraftingMaterialSearch)
+	if input.Filters.Sort == "rank" {
+		v.Check(input.SearchMode == data.SearchModeFullText, "sort", "rank is only available in fulltext search mode")
+		v.Check(!input.Filters.Keyset, "sort", "rank is not available with cursor pagination")
+	}
+	if input.Currency != "" {
+		v.Check(data.ValidCurrency(input.Currency), "currency", "must be a supported currency")
+		v.Check(app.rates != nil, "currency", "price conversion is not available")
+	}
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+
+	if !app.checkIncludeDeleted(w, r, input.IncludeDeleted) {
+		return
+	}
 	// Call the GetAll() method to retrieve the movies, passing in the various filter
 	// parameters.
-	crafting_materials, metadata, err := app.models.CraftingMaterials.GetAll(input.Title, input.Filters)
+	crafting_materials, metadata, err := app.models.CraftingMaterials.GetAll(input.CraftingMaterialSearch, input.Filters)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if input.Currency != "" {
+		err = app.convertPrices(crafting_materials, input.Currency)
+		if err != nil {
+			switch {
+			case errors.Is(err, rates.ErrUnknownCurrency):
+				v.AddError("currency", err.Error())
+				app.failedValidationResponse(w, r, v.Errors)
+			case errors.Is(err, data.ErrPriceOutOfRange):
+				v.AddError("currency", "a converted price is out of range")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
 	// Send a JSON response containing the movie data.
 	err = app.writeJSON(w, http.StatusOK, envelope{
 		"crafting_materials": crafting_materials,
@@ -212,3 +416,46 @@ func (app *application) listCraftingMaterialsHandler(w http.ResponseWriter, r *h
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The convertPrices() helper converts the price of each crafting material into the given
+// currency using the configured exchange rates provider.
+func (app *application) convertPrices(materials []*data.CraftingMaterials, currency string) error {
+	for _, material := range materials {
+		rate, err := app.rates.Rate(material.Price.Currency, currency)
+		if err != nil {
+			return err
+		}
+
+		material.Price, err = material.Price.Convert(currency, rate)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purgeDeletedCraftingMaterials removes crafting materials which have been soft deleted
+// for longer than the configured retention. It is run periodically by serve().
+func (app *application) purgeDeletedCraftingMaterials() {
+	purged, keys, err := app.models.CraftingMaterials.PurgeDeleted(app.config.purge.retention)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	// The attachment records went with the crafting materials, so remove their files
+	// too.
+	for _, key := range keys {
+		err := app.storage.Delete(key)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"key": key})
+		}
+	}
+
+	if purged > 0 {
+		app.logger.PrintInfo("purged deleted crafting materials", map[string]string{
+			"count": strconv.FormatInt(purged, 10),
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/validator"
+	"net/http"
+	"strconv"
+)
+
+// The maximum number of crafting materials which can be sent in a single bulk request.
+const maxBulkItems = 100
+
+func validateBulkSize(v *validator.Validator, size int) {
+	v.Check(size > 0, "items", "must contain at least 1 item")
+	v.Check(size <= maxBulkItems, "items", "must not contain more than 100 items")
+}
+
+// The checkCategories() helper looks up the categories of the given crafting materials,
+// which are keyed by item index or line number, and adds a category_id error to
+// itemErrors under the same key for each one which doesn't exist.
+func (app *application) checkCategories(materials map[string]*data.CraftingMaterials, itemErrors map[string]map[string]string) error {
+	var ids []int64
+	for _, material := range materials {
+		if material.CategoryID != nil {
+			ids = append(ids, *material.CategoryID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	existing, err := app.models.Categories.Exist(ids)
+	if err != nil {
+		return err
+	}
+
+	for key, material := range materials {
+		if material.CategoryID == nil || existing[*material.CategoryID] {
+			continue
+		}
+		if itemErrors[key] == nil {
+			itemErrors[key] = make(map[string]string)
+		}
+		itemErrors[key]["category_id"] = "must be an existing category"
+	}
+
+	return nil
+}
+
+// The invalidCategoryResponse() method is used when a category is deleted between
+// checkCategories() and the write which depends on it.
+func (app *application) invalidCategoryResponse(w http.ResponseWriter, r *http.Request) {
+	app.failedValidationResponse(w, r, map[string]string{"category_id": "must be an existing category"})
+}
+
+func (app *application) bulkCreateCraftingMaterialsHandler(w http.ResponseWriter, r *http.Request) {
+	var input []struct {
+		Title      string     `json:"title"`
+		Year       int32      `json:"year"`
+		Price      data.Price `json:"price"`
+		CategoryID *int64     `json:"category_id"`
+		Tags       []string   `json:"tags"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if validateBulkSize(v, len(input)); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Validate every item up front and collect the errors keyed by the index of the
+	// item in the request body.
+	craftingMaterials := make([]*data.CraftingMaterials, len(input))
+	byKey := make(map[string]*data.CraftingMaterials, len(input))
+	itemErrors := make(map[string]map[string]string)
+
+	for i, item := range input {
+		craftingMaterials[i] = &data.CraftingMaterials{
+			Title:      item.Title,
+			Year:       item.Year,
+			Price:      item.Price,
+			CategoryID: item.CategoryID,
+			Tags:       data.NormalizeTags(item.Tags),
+		}
+		byKey[strconv.Itoa(i)] = craftingMaterials[i]
+
+		v := validator.New()
+		if data.ValidateCraftingMaterial(v, craftingMaterials[i]); !v.Valid() {
+			itemErrors[strconv.Itoa(i)] = v.Errors
+		}
+	}
+
+	err = app.checkCategories(byKey, itemErrors)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if len(itemErrors) > 0 {
+		app.failedBulkValidationResponse(w, r, itemErrors)
+		return
+	}
+
+	err = app.models.CraftingMaterials.InsertMany(craftingMaterials, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCategory):
+			app.invalidCategoryResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"crafting_materials": craftingMaterials}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) bulkUpdateCraftingMaterialsHandler(w http.ResponseWriter, r *http.Request) {
+	var input []struct {
+		ID         int64       `json:"id"`
+		Version    int32       `json:"version"`
+		Title      *string     `json:"title"`
+		Year       *int32      `json:"year"`
+		Price      *data.Price `json:"price"`
+		CategoryID *int64      `json:"category_id"`
+		Tags       []string    `json:"tags"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	ids := make([]string, len(input))
+	for i, item := range input {
+		ids[i] = strconv.FormatInt(item.ID, 10)
+	}
+	validateBulkSize(v, len(input))
+	v.Check(validator.Unique(ids), "items", "must not contain duplicate ids")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	craftingMaterials := make([]*data.CraftingMaterials, len(input))
+	byKey := make(map[string]*data.CraftingMaterials, len(input))
+	oldValues := make([]*data.CraftingMaterialSnapshot, len(input))
+	itemErrors := make(map[string]map[string]string)
+
+	for i, item := range input {
+		key := strconv.Itoa(i)
+
+		v := validator.New()
+		v.Check(item.ID > 0, "id", "must be provided")
+		v.Check(item.Version > 0, "version", "must be provided")
+		if !v.Valid() {
+			itemErrors[key] = v.Errors
+			continue
+		}
+
+		craftingMaterial, err := app.models.CraftingMaterials.Get(item.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				itemErrors[key] = map[string]string{"id": "the requested resource could not be found"}
+				continue
+			default:
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		// Each item carries the version the client last saw, which is checked here
+		// and again by the WHERE clause in UpdateMany().
+		if craftingMaterial.Version != item.Version {
+			itemErrors[key] = map[string]string{"version": "unable to update the record due to an edit conflict"}
+			continue
+		}
+
+		oldValues[i] = craftingMaterial.Snapshot()
+
+		if item.Title != nil {
+			craftingMaterial.Title = *item.Title
+		}
+		if item.Year != nil {
+			craftingMaterial.Year = *item.Year
+		}
+		if item.Price != nil {
+			craftingMaterial.Price = *item.Price
+		}
+		if item.CategoryID != nil {
+			craftingMaterial.CategoryID = item.CategoryID
+			if *item.CategoryID == 0 {
+				craftingMaterial.CategoryID = nil
+			}
+		}
+		if item.Tags != nil {
+			craftingMaterial.Tags = data.NormalizeTags(item.Tags)
+		}
+
+		if data.ValidateCraftingMaterial(v, craftingMaterial); !v.Valid() {
+			itemErrors[key] = v.Errors
+			continue
+		}
+
+		craftingMaterials[i] = craftingMaterial
+		byKey[key] = craftingMaterial
+	}
+
+	err = app.checkCategories(byKey, itemErrors)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if len(itemErrors) > 0 {
+		app.failedBulkValidationResponse(w, r, itemErrors)
+		return
+	}
+
+	conflicts, err := app.models.CraftingMaterials.UpdateMany(craftingMaterials, oldValues, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCategory):
+			app.invalidCategoryResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if len(conflicts) > 0 {
+		for i := range conflicts {
+			itemErrors[strconv.Itoa(i)] = map[string]string{"version": "unable to update the record due to an edit conflict"}
+		}
+		app.bulkEditConflictResponse(w, r, itemErrors)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"crafting_materials": craftingMaterials}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) bulkDeleteCraftingMaterialsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IDs []int64 `json:"ids"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	ids := make([]string, len(input.IDs))
+	for i, id := range input.IDs {
+		ids[i] = strconv.FormatInt(id, 10)
+		v.Check(id > 0, "ids", "must only contain positive integers")
+	}
+	validateBulkSize(v, len(input.IDs))
+	v.Check(validator.Unique(ids), "ids", "must not contain duplicate values")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	failed, err := app.models.CraftingMaterials.DeleteMany(input.IDs, app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Missing ids are reported with a 404, unless any of the crafting materials are
+	// used by recipes, which makes it a 409.
+	if len(failed) > 0 {
+		status := http.StatusNotFound
+		itemErrors := make(map[string]map[string]string)
+		for i, err := range failed {
+			switch {
+			case errors.Is(err, data.ErrCraftingMaterialInUse):
+				status = http.StatusConflict
+				itemErrors[strconv.Itoa(i)] = map[string]string{"id": "the crafting material is used by a recipe"}
+			default:
+				itemErrors[strconv.Itoa(i)] = map[string]string{"id": "the requested resource could not be found"}
+			}
+		}
+		app.errorResponse(w, r, status, itemErrors)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "crafting materials successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/validator"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// Imports are not limited by the 1MB cap used by readJSON().
+const maxImportBytes = 10 * 1024 * 1024
+
+var errEmptyImport = errors.New("body must contain at least one crafting material")
+
+// Tags are held in a single CSV column, separated by semicolons.
+const csvTagSeparator = ";"
+
+// craftingMaterialRecord holds the fields of a crafting material which an import
+// accepts. NDJSON exports write the same fields, so that an export can be imported
+// again; the id, version and other fields set by the server are left out.
+type craftingMaterialRecord struct {
+	Title      string     `json:"title"`
+	Year       int32      `json:"year"`
+	Price      data.Price `json:"price"`
+	CategoryID *int64     `json:"category_id,omitempty"`
+	Tags       []string   `json:"tags"`
+}
+
+func newCraftingMaterialRecord(material *data.CraftingMaterials) craftingMaterialRecord {
+	return craftingMaterialRecord{
+		Title:      material.Title,
+		Year:       material.Year,
+		Price:      material.Price,
+		CategoryID: material.CategoryID,
+		Tags:       material.Tags,
+	}
+}
+
+func formatCategoryID(id *int64) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatInt(*id, 10)
+}
+
+func (app *application) exportCraftingMaterialsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Format string
+		data.CraftingMaterialSearch
+		data.Filters
+	}
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Format = app.readString(qs, "format", formatCSV)
+	input.CraftingMaterialSearch = app.readCraftingMaterialSearch(qs, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = craftingMaterialsSortSafelist
+
+	v.Check(validator.In(input.Format, formatCSV, formatNDJSON), "format", "must be either csv or ndjson")
+	data.ValidateCraftingMaterialSearch(v, input.CraftingMaterialSearch)
+	data.ValidateCraftingMaterialSort(v, input.Filters.Sort, input.CraftingMaterialSearch)
+	if input.Filters.Sort == "rank" {
+		v.Check(input.SearchMode == data.SearchModeFullText, "sort", "rank is only available in fulltext search mode")
+	}
+	v.Check(validator.In(input.Filters.Sort, input.Filters.SortSafelist...), "sort", "invalid sort value")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkIncludeDeleted(w, r, input.IncludeDeleted) {
+		return
+	}
+
+	var (
+		write func(*data.CraftingMaterials) error
+		flush func() error
+	)
+
+	// The CSV writer buffers its output, so whether the status code has been sent
+	// depends on what has actually reached w, not on how many rows have been written.
+	out := &writeTracker{w: w}
+
+	switch input.Format {
+	case formatCSV:
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="crafting_materials.csv"`)
+
+		cw := csv.NewWriter(out)
+		write = func(material *data.CraftingMaterials) error {
+			return cw.Write([]string{
+				strconv.FormatInt(material.ID, 10),
+				material.Title,
+				strconv.FormatInt(int64(material.Year), 10),
+				data.FormatAmount(material.Price.Amount, material.Price.Currency),
+				material.Price.Currency,
+				formatCategoryID(material.CategoryID),
+				strings.Join(material.Tags, csvTagSeparator),
+				strconv.FormatInt(int64(material.Version), 10),
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+
+		// Write the header row before any data.
+		cw.Write([]string{"id", "title", "year", "price", "currency", "category_id", "tags", "version"})
+	case formatNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="crafting_materials.ndjson"`)
+
+		enc := json.NewEncoder(out)
+		write = func(material *data.CraftingMaterials) error {
+			return enc.Encode(newCraftingMaterialRecord(material))
+		}
+		flush = func() error {
+			return nil
+		}
+	}
+
+	err := app.models.CraftingMaterials.Stream(input.CraftingMaterialSearch, input.Filters, write)
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		// Once anything has been written the status code has been sent, so the error
+		// can only be logged. Otherwise the client gets a normal error response.
+		if out.written {
+			app.logError(r, err)
+			return
+		}
+
+		w.Header().Del("Content-Disposition")
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// writeTracker records whether anything has been written to the underlying writer.
+type writeTracker struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *writeTracker) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		t.written = true
+	}
+	return t.w.Write(p)
+}
+
+func (app *application) importCraftingMaterialsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	format := app.readString(r.URL.Query(), "format", formatCSV)
+	if v.Check(validator.In(format, formatCSV, formatNDJSON), "format", "must be either csv or ndjson"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	var (
+		craftingMaterials []*data.CraftingMaterials
+		lineErrors        map[string]map[string]string
+		err               error
+	)
+
+	switch format {
+	case formatCSV:
+		craftingMaterials, lineErrors, err = readCraftingMaterialsCSV(r.Body)
+	case formatNDJSON:
+		craftingMaterials, lineErrors, err = readCraftingMaterialsNDJSON(r.Body)
+	}
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Run the usual validation against every row which could be parsed, keeping the
+	// errors keyed by line number.
+	byLine := make(map[string]*data.CraftingMaterials)
+	for line, material := range craftingMaterials {
+		if material == nil {
+			continue
+		}
+		byLine[strconv.Itoa(line)] = material
+
+		v := validator.New()
+		if data.ValidateCraftingMaterial(v, material); !v.Valid() {
+			lineErrors[strconv.Itoa(line)] = v.Errors
+		}
+	}
+
+	err = app.checkCategories(byLine, lineErrors)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if len(lineErrors) > 0 {
+		app.failedBulkValidationResponse(w, r, lineErrors)
+		return
+	}
+
+	// Drop the placeholders for blank lines and the header before inserting.
+	materials := make([]*data.CraftingMaterials, 0, len(craftingMaterials))
+	for _, material := range craftingMaterials {
+		if material != nil {
+			materials = append(materials, material)
+		}
+	}
+
+	if len(materials) == 0 {
+		app.badRequestResponse(w, r, errEmptyImport)
+		return
+	}
+
+	err = app.models.CraftingMaterials.InsertMany(materials, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCategory):
+			app.invalidCategoryResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"imported": len(materials)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readCraftingMaterialsCSV parses a CSV import. The first row must be a header naming
+// the title, year and price columns, and optionally currency, category_id and tags
+// columns, in any order. Prices are decimal amounts in the row's currency, or in USD if
+// there is no currency column. Tags are separated by semicolons. The returned slice is
+// indexed by line number, with nil entries for lines which don't hold a crafting
+// material.
+func readCraftingMaterialsCSV(body io.Reader) ([]*data.CraftingMaterials, map[string]map[string]string, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, errEmptyImport
+		}
+		return nil, nil, fmt.Errorf("body contains badly-formed CSV: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"title", "year", "price"} {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, fmt.Errorf("CSV header must contain a %q column", name)
+		}
+	}
+
+	craftingMaterials := []*data.CraftingMaterials{nil, nil}
+	lineErrors := make(map[string]map[string]string)
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("body contains badly-formed CSV: %w", err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		for len(craftingMaterials) <= line {
+			craftingMaterials = append(craftingMaterials, nil)
+		}
+
+		v := validator.New()
+
+		year, err := strconv.ParseInt(record[columns["year"]], 10, 32)
+		v.Check(err == nil, "year", "must be an integer value")
+
+		currency := data.DefaultCurrency
+		if i, ok := columns["currency"]; ok {
+			currency = strings.ToUpper(record[i])
+		}
+
+		amount, err := data.ParseAmount(record[columns["price"]], currency)
+		switch {
+		case errors.Is(err, data.ErrUnknownCurrency):
+			v.AddError("currency", "must be a supported currency")
+		case err != nil:
+			v.AddError("price", "must be a decimal amount")
+		}
+
+		var categoryID *int64
+		if i, ok := columns["category_id"]; ok && record[i] != "" {
+			id, err := strconv.ParseInt(record[i], 10, 64)
+			v.Check(err == nil, "category_id", "must be an integer value")
+			categoryID = &id
+		}
+
+		var tags []string
+		if i, ok := columns["tags"]; ok && record[i] != "" {
+			tags = strings.Split(record[i], csvTagSeparator)
+		}
+
+		if !v.Valid() {
+			lineErrors[strconv.Itoa(line)] = v.Errors
+			continue
+		}
+
+		craftingMaterials[line] = &data.CraftingMaterials{
+			Title:      record[columns["title"]],
+			Year:       int32(year),
+			Price:      data.Price{Amount: amount, Currency: currency},
+			CategoryID: categoryID,
+			Tags:       data.NormalizeTags(tags),
+		}
+	}
+
+	return craftingMaterials, lineErrors, nil
+}
+
+// readCraftingMaterialsNDJSON parses an NDJSON import, where each non-blank line holds
+// the same JSON object accepted by the create endpoint, as written by an NDJSON export. The returned slice is indexed
+// by line number, with nil entries for lines which don't hold a crafting material.
+func readCraftingMaterialsNDJSON(body io.Reader) ([]*data.CraftingMaterials, map[string]map[string]string, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportBytes)
+
+	craftingMaterials := []*data.CraftingMaterials{nil}
+	lineErrors := make(map[string]map[string]string)
+
+	for line := 1; scanner.Scan(); line++ {
+		craftingMaterials = append(craftingMaterials, nil)
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var input craftingMaterialRecord
+
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&input)
+		if err != nil {
+			lineErrors[strconv.Itoa(line)] = map[string]string{"json": err.Error()}
+			continue
+		}
+
+		craftingMaterials[line] = &data.CraftingMaterials{
+			Title:      input.Title,
+			Year:       input.Year,
+			Price:      input.Price,
+			CategoryID: input.CategoryID,
+			Tags:       data.NormalizeTags(input.Tags),
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return craftingMaterials, lineErrors, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"greenlight.dimash.net/internal/data"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// An NDJSON export must be accepted by the NDJSON import, so that crafting materials
+// can be moved between servers.
+func TestCraftingMaterialsNDJSONRoundTrip(t *testing.T) {
+	categoryID := int64(7)
+	deletedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	materials := []*data.CraftingMaterials{
+		{
+			ID:           1,
+			Title:        "Iron Ingot",
+			Year:         2020,
+			Price:        data.Price{Amount: 1250, Currency: "EUR"},
+			CategoryID:   &categoryID,
+			CategoryPath: []string{"Metals", "Ingots"},
+			Tags:         []string{"metal", "smelted"},
+			Version:      3,
+			DeletedAt:    &deletedAt,
+		},
+		{
+			ID:      2,
+			Title:   "Oak Plank",
+			Year:    1999,
+			Price:   data.Price{Amount: 5, Currency: "JPY"},
+			Tags:    []string{},
+			Version: 1,
+		},
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	for _, material := range materials {
+		err := enc.Encode(newCraftingMaterialRecord(material))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	imported, lineErrors, err := readCraftingMaterialsNDJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lineErrors) > 0 {
+		t.Fatalf("got line errors %v; want none", lineErrors)
+	}
+
+	if len(imported) != len(materials)+1 {
+		t.Fatalf("got %d lines; want %d", len(imported)-1, len(materials))
+	}
+
+	for i, want := range materials {
+		got := imported[i+1]
+		if got == nil {
+			t.Fatalf("line %d: got no crafting material", i+1)
+		}
+
+		if got.Title != want.Title || got.Year != want.Year || got.Price != want.Price {
+			t.Errorf("line %d: got %q %d %v; want %q %d %v", i+1, got.Title, got.Year, got.Price, want.Title, want.Year, want.Price)
+		}
+
+		if !reflect.DeepEqual(got.CategoryID, want.CategoryID) {
+			t.Errorf("line %d: got category id %v; want %v", i+1, got.CategoryID, want.CategoryID)
+		}
+
+		if !reflect.DeepEqual(got.Tags, want.Tags) {
+			t.Errorf("line %d: got tags %v; want %v", i+1, got.Tags, want.Tags)
+		}
+	}
+}
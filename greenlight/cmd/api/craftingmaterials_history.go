@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/validator"
+	"net/http"
+)
+
+func (app *application) showCraftingMaterialHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	revisions, err := app.models.CraftingMaterialHistory.GetAllForCraftingMaterial(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The history outlives the crafting material, so it's only missing if there are no
+	// revisions either. Crafting materials created before history was recorded have
+	// none.
+	if len(revisions) == 0 {
+		_, err = app.models.CraftingMaterials.GetIncludingDeleted(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"history": revisions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The revertCraftingMaterialHandler() restores the values a crafting material had at
+// an earlier version. The revert is saved as a normal update, so it bumps the version
+// and fails with an edit conflict if the crafting material changes concurrently. As
+// with updates, the client can say which version it expects to be reverting, either
+// with If-Match or with expected_version, so that it doesn't overwrite a change it
+// hasn't seen.
+func (app *application) revertCraftingMaterialHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Version         int32  `json:"version"`
+		ExpectedVersion *int32 `json:"expected_version"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Version > 0, "version", "must be a positive integer"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	craftingMaterial, err := app.models.CraftingMaterials.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkIfMatch(w, r, craftingMaterial.Version) {
+		return
+	}
+
+	if input.ExpectedVersion != nil && *input.ExpectedVersion != craftingMaterial.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	revision, err := app.models.CraftingMaterialHistory.GetVersion(id, input.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("version", "no revision with this version exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	oldValues := craftingMaterial.Snapshot()
+	revision.NewValues.Apply(craftingMaterial)
+
+	if data.ValidateCraftingMaterial(v, craftingMaterial); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.CraftingMaterials.Update(craftingMaterial, oldValues, data.HistoryActionRevert, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCategory):
+			v.AddError("version", "the category of this revision no longer exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(craftingMaterial.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"crafting_material": craftingMaterial}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"greenlight.dimash.net/internal/data"
 	"greenlight.dimash.net/internal/validator"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Retrieve the "id" URL parameter from the current request context, then convert it to
@@ -26,6 +28,18 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// The readInt64Param() helper is like readIDParam() for URL parameters with other names.
+func (app *application) readInt64Param(r *http.Request, name string) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid %s parameter", name)
+	}
+
+	return id, nil
+}
+
 // Define an envelope type.
 type envelope map[string]interface{}
 
@@ -134,6 +148,90 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readAmount() helper reads a decimal amount of money in the given currency from
+// the query string and returns it in minor units, or 0 if no matching key could be
+// found. If the value couldn't be parsed we record an error message in the provided
+// Validator instance.
+func (app *application) readAmount(qs url.Values, key string, currency string, v *validator.Validator) int64 {
+	s := qs.Get(key)
+	if s == "" || !data.ValidCurrency(currency) {
+		return 0
+	}
+
+	amount, err := data.ParseAmount(s, currency)
+	if err != nil {
+		v.AddError(key, "must be a decimal amount in "+currency)
+		return 0
+	}
+
+	return amount
+}
+
+// The readBool() helper reads a boolean value from the query string. If no matching key
+// could be found it returns the provided default value, and if the value couldn't be
+// parsed we record an error message in the provided Validator instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// The etag() helper returns the entity tag for a record at the given version.
+func etag(version int32) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// The matchesETag() helper reports whether the value of an If-Match or If-None-Match
+// header matches the given entity tag. The header may hold a comma-separated list of
+// tags or the "*" wildcard, which matches any tag. If-None-Match uses the weak
+// comparison, which ignores a W/ prefix, while If-Match needs the strong comparison,
+// under which a weak tag never matches (RFC 9110 section 8.8.3.2).
+func matchesETag(header, tag string, weak bool) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if weak {
+			value = strings.TrimPrefix(value, "W/")
+		}
+		if value == "*" || value == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The checkIfMatch() helper checks the If-Match header of a request which modifies a
+// record at the given version. It sends a 412 Precondition Failed response if the
+// client's version is stale, or a 428 Precondition Required response if the header is
+// missing and the server requires it, and returns false in either case.
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, version int32) bool {
+	ifMatch := r.Header.Get("If-Match")
+
+	if ifMatch == "" {
+		if app.config.requireIfMatch {
+			app.preconditionRequiredResponse(w, r)
+			return false
+		}
+		return true
+	}
+
+	if !matchesETag(ifMatch, etag(version), false) {
+		app.preconditionFailedResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
 func (app *application) background(fn func()) {
 	// Launch a background goroutine.
 	app.wg.Add(1)
@@ -152,3 +250,30 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// The periodically() helper calls fn every interval until done is closed. Like the
+// background() tasks its goroutine is tracked by app.wg, so that shutdown waits for a
+// run which is part way through. A non-positive interval disables it.
+func (app *application) periodically(done <-chan struct{}, interval time.Duration, fn func()) {
+	if interval <= 0 {
+		return
+	}
+
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
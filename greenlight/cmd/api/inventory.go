@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/validator"
+	"net/http"
+)
+
+// The readInventoryItem() helper reads the crafting material id from the URL and looks
+// up the authenticated user's quantity of it. It sends a 404 response and returns nil
+// if the crafting material doesn't exist.
+func (app *application) readInventoryItem(w http.ResponseWriter, r *http.Request) *data.InventoryItem {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	user := app.contextGetUser(r)
+
+	item, err := app.models.Inventory.Get(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return item
+}
+
+func (app *application) listInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	items, err := app.models.Inventory.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"inventory": items}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showInventoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	item := app.readInventoryItem(w, r)
+	if item == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"inventory_item": item}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) setInventoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	item := app.readInventoryItem(w, r)
+	if item == nil {
+		return
+	}
+
+	var input struct {
+		Quantity *int64 `json:"quantity"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Quantity != nil, "quantity", "must be provided")
+	if input.Quantity != nil {
+		v.Check(*input.Quantity >= 0, "quantity", "must not be negative")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	updated, err := app.models.Inventory.Set(user.ID, item.CraftingMaterialID, *input.Quantity)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	updated.Title = item.Title
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"inventory_item": updated}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) incrementInventoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	app.adjustInventoryItem(w, r, 1)
+}
+
+func (app *application) decrementInventoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	app.adjustInventoryItem(w, r, -1)
+}
+
+// The adjustInventoryItem() method adds the amount in the request body, multiplied by
+// sign, to the authenticated user's quantity of a crafting material. A decrement which
+// would take the quantity below zero is refused with a 409 response, and an increment
+// which would take it past the largest quantity that can be stored with a 422.
+func (app *application) adjustInventoryItem(w http.ResponseWriter, r *http.Request, sign int64) {
+	item := app.readInventoryItem(w, r)
+	if item == nil {
+		return
+	}
+
+	var input struct {
+		Amount int64 `json:"amount"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Amount > 0, "amount", "must be a positive integer"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	updated, err := app.models.Inventory.Adjust(user.ID, item.CraftingMaterialID, sign*input.Amount)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrInsufficientQuantity):
+			app.errorResponse(w, r, http.StatusConflict, "the inventory does not hold enough of this crafting material")
+		case errors.Is(err, data.ErrQuantityOutOfRange):
+			v.AddError("amount", "would make the quantity too large")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	updated.Title = item.Title
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"inventory_item": updated}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteInventoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Inventory.Delete(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "crafting material successfully removed from inventory"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listCraftableFromInventoryHandler() is the same query as
+// listCraftableRecipesHandler(), run against the authenticated user's inventory.
+func (app *application) listCraftableFromInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	inventory, err := app.models.Inventory.Quantities(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	recipes := []*data.CraftableRecipe{}
+	if len(inventory) > 0 {
+		recipes, err = app.models.Recipes.Craftable(inventory)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recipes": recipes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/jwt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The "iss" claim of the JWTs issued by the API.
+const jwtIssuer = "greenlight.dimash.net"
+
+// accessTokenClaims are the claims of a JWT access token. They carry everything the
+// middleware needs to know about the user, so that the token can be checked without a
+// database query.
+type accessTokenClaims struct {
+	jwt.Claims
+	SessionID int64 `json:"sid"`
+	Activated bool  `json:"activated"`
+}
+
+// The loadJWTKeys() function loads the keys named by the jwt-keys setting, which is a
+// list of id=path pairs. The signing key defaults to the first key listed.
+func loadJWTKeys(cfg config) (*jwt.KeySet, error) {
+	if len(cfg.tokens.jwtKeys) == 0 {
+		return nil, errors.New("jwt-keys must be set when access-token-format is jwt")
+	}
+
+	keys := make([]*jwt.Key, len(cfg.tokens.jwtKeys))
+
+	for i, pair := range cfg.tokens.jwtKeys {
+		id, path, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("jwt-keys: %q must be in the form id=path", pair)
+		}
+
+		key, err := jwt.LoadKey(id, path)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+
+	signingKeyID := cfg.tokens.jwtSigningKey
+	if signingKeyID == "" {
+		signingKeyID = keys[0].ID
+	}
+
+	return jwt.NewKeySet(signingKeyID, keys...)
+}
+
+// The accessTokenTTL() method returns the lifetime of the opaque access tokens stored
+// alongside refresh tokens. In JWT mode it's zero, as the access tokens are JWTs
+// issued by newJWTAccessToken() instead.
+func (app *application) accessTokenTTL() time.Duration {
+	if app.jwtKeys != nil {
+		return 0
+	}
+	return app.config.tokens.accessTTL
+}
+
+// The newJWTAccessToken() method issues a signed JWT access token for the user, in the
+// session whose refresh token is given. It's returned as a data.Token so that responses
+// look the same as with opaque tokens.
+func (app *application) newJWTAccessToken(user *data.User, refreshToken *data.Token) (*data.Token, error) {
+	now := time.Now()
+	expiry := now.Add(app.config.tokens.accessTTL)
+
+	claims := accessTokenClaims{
+		Claims: jwt.Claims{
+			Issuer:    jwtIssuer,
+			Subject:   strconv.FormatInt(user.ID, 10),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			Expiry:    expiry.Unix(),
+		},
+		SessionID: *refreshToken.FamilyID,
+		Activated: user.Activated,
+	}
+
+	plaintext, err := app.jwtKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{Plaintext: plaintext, UserID: user.ID, Expiry: time.Unix(claims.Expiry, 0), Scope: data.ScopeAuthentication}, nil
+}
+
+// The verifyJWTAccessToken() method checks a JWT access token and returns the user and
+// session it was issued for. The user only has its ID and Activated fields set.
+func (app *application) verifyJWTAccessToken(token string) (*data.User, int64, error) {
+	var claims accessTokenClaims
+
+	err := app.jwtKeys.Verify(token, time.Now(), &claims)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if claims.Issuer != jwtIssuer {
+		return nil, 0, jwt.ErrInvalidToken
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, 0, jwt.ErrInvalidToken
+	}
+
+	return &data.User{ID: id, Activated: claims.Activated}, claims.SessionID, nil
+}
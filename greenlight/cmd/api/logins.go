@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"greenlight.dimash.net/internal/data"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loginThrottleKey identifies one of the counters of failed logins which a login
+// attempt is checked against.
+type loginThrottleKey struct {
+	scope string
+	key   string
+}
+
+// The loginThrottleKeys() method returns the counters for a login attempt: one for the
+// email address, whether or not an account exists for it, so that lockouts don't reveal
+// which addresses are registered, and one for the client's IP address.
+func (app *application) loginThrottleKeys(r *http.Request, email string) ([]loginThrottleKey, error) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []loginThrottleKey
+	if app.config.login.maxFailures > 0 {
+		keys = append(keys, loginThrottleKey{data.ThrottleScopeAccount, strings.ToLower(email)})
+	}
+	if app.config.login.maxIPFailures > 0 {
+		keys = append(keys, loginThrottleKey{data.ThrottleScopeIP, ip})
+	}
+
+	return keys, nil
+}
+
+func (app *application) loginThreshold(scope string) int {
+	if scope == data.ThrottleScopeIP {
+		return app.config.login.maxIPFailures
+	}
+	return app.config.login.maxFailures
+}
+
+// The reserveLoginAttempt() method counts a login attempt as a failure against each
+// of the keys before the credentials are checked, and returns the updated counts in
+// the same order as the keys. If any key is still backing off or locked out, nothing
+// is counted and how long the client has to wait is returned instead.
+func (app *application) reserveLoginAttempt(keys []loginThrottleKey) ([]*data.LoginThrottle, time.Duration, error) {
+	throttles := make([]*data.LoginThrottle, 0, len(keys))
+
+	for _, k := range keys {
+		throttle, retryAfter, err := app.models.LoginThrottles.Reserve(k.scope, k.key, app.loginThreshold(k.scope), app.config.login.lockoutDuration)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if throttle == nil {
+			// Hand back the keys which were already counted, so that a refused
+			// attempt doesn't count against them.
+			err = app.releaseLoginAttempt(keys[:len(throttles)])
+			if err != nil {
+				return nil, 0, err
+			}
+			return nil, retryAfter, nil
+		}
+
+		throttles = append(throttles, throttle)
+	}
+
+	return throttles, 0, nil
+}
+
+// The releaseLoginAttempt() method hands back an attempt counted by
+// reserveLoginAttempt() which turned out not to be a failure.
+func (app *application) releaseLoginAttempt(keys []loginThrottleKey) error {
+	for _, k := range keys {
+		err := app.models.LoginThrottles.Release(k.scope, k.key, app.loginThreshold(k.scope))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The loginSucceeded() method is called once a user has completely logged in. It
+// clears the account's failures, but only hands back the attempt for the IP address, so
+// that an attacker can't reset their count by logging in to an account of their own
+// between guesses.
+func (app *application) loginSucceeded(keys []loginThrottleKey) error {
+	for _, k := range keys {
+		var err error
+		if k.scope == data.ThrottleScopeAccount {
+			err = app.models.LoginThrottles.Reset(k.scope, k.key)
+		} else {
+			err = app.models.LoginThrottles.Release(k.scope, k.key, app.loginThreshold(k.scope))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The loginFailed() method is called when the credentials of an attempt reserved by
+// reserveLoginAttempt() are wrong, which leaves it counted as a failure. When this has
+// locked an existing user's account, they're sent an email about it.
+func (app *application) loginFailed(keys []loginThrottleKey, throttles []*data.LoginThrottle, user *data.User) {
+	for i, k := range keys {
+		// Only the failure which reaches the threshold locks; later attempts are
+		// refused before they're counted.
+		if throttles[i].Failures != app.loginThreshold(k.scope) {
+			continue
+		}
+
+		app.logger.PrintInfo("login locked after too many failures", map[string]string{
+			"scope": k.scope,
+			"key":   k.key,
+		})
+
+		if k.scope == data.ThrottleScopeAccount && user != nil {
+			app.background(func() {
+				data := map[string]interface{}{
+					"lockoutMinutes": int(app.config.login.lockoutDuration.Minutes()),
+				}
+
+				err := app.mailer.Send(user.Email, "account_locked.tmpl", data)
+				if err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
+	}
+}
+
+// The purgeLoginThrottles() method deletes the counts of failed logins which have
+// expired. It is run periodically by serve().
+func (app *application) purgeLoginThrottles() {
+	count, err := app.models.LoginThrottles.DeleteExpired(app.config.login.lockoutDuration)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if count > 0 {
+		app.logger.PrintInfo("purged expired login throttles", map[string]string{
+			"count": strconv.FormatInt(count, 10),
+		})
+	}
+}
+
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	message := fmt.Sprintf("too many failed login attempts, please try again in %d seconds", seconds)
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// The unlockUserHandler() lets an administrator lift the lockout on a user's account
+// before it expires, for example once the user has confirmed their identity.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.LoginThrottles.Reset(data.ThrottleScopeAccount, strings.ToLower(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "account successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"flag"
+	"fmt"
 	_ "github.com/lib/pq"
 	"greenlight.dimash.net/internal/data"
 	"greenlight.dimash.net/internal/jsonlog"
+	"greenlight.dimash.net/internal/jwt"
 	"greenlight.dimash.net/internal/mailer"
+	"greenlight.dimash.net/internal/rates"
+	"greenlight.dimash.net/internal/storage"
 	"os"
 	"strings"
 	"sync"
@@ -46,17 +50,50 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	requireIfMatch bool
+	rates          struct {
+		file          string
+		checkInterval time.Duration
+	}
+	purge struct {
+		retention time.Duration
+		interval  time.Duration
+	}
+	attachments struct {
+		dir     string
+		maxSize int64
+	}
+	tokens struct {
+		accessTTL     time.Duration
+		refreshTTL    time.Duration
+		format        string
+		jwtKeys       []string
+		jwtSigningKey string
+	}
+	totp struct {
+		issuer string
+	}
+	login struct {
+		maxFailures     int
+		maxIPFailures   int
+		lockoutDuration time.Duration
+	}
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers, helpers,
 // and middleware. At the moment this only contains a copy of the config struct and a
 // logger, but it will grow to include a lot more as our build progresses.
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config  config
+	logger  *jsonlog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	rates   rates.Provider
+	storage storage.Store
+	jwtKeys *jwt.KeySet
+	wg      sync.WaitGroup
+	// thumbnailSlots limits how many thumbnails are generated at once.
+	thumbnailSlots chan struct{}
 }
 
 func main() {
@@ -86,6 +123,32 @@ func main() {
 		return nil
 	})
 
+	flag.DurationVar(&cfg.purge.retention, "purge-retention", 30*24*time.Hour, "How long soft deleted crafting materials are kept (0 disables purging)")
+	flag.DurationVar(&cfg.purge.interval, "purge-interval", time.Hour, "How often soft deleted crafting materials, expired tokens and expired login throttles are purged")
+
+	flag.BoolVar(&cfg.requireIfMatch, "require-if-match", false, "Require an If-Match header on PATCH and DELETE requests for crafting materials")
+
+	flag.StringVar(&cfg.rates.file, "rates-file", os.Getenv("GREENLIGHT_RATES_FILE"), "Exchange rates file (.json or .csv) used for price conversion")
+	flag.DurationVar(&cfg.rates.checkInterval, "rates-check-interval", time.Minute, "How often the exchange rates file is checked for changes")
+
+	flag.StringVar(&cfg.attachments.dir, "attachments-dir", "./uploads", "Directory where crafting material attachments are stored")
+	flag.Int64Var(&cfg.attachments.maxSize, "attachments-max-size", 10*1024*1024, "Maximum size of an uploaded attachment in bytes")
+
+	flag.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "How long an authentication (access) token is valid for")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "How long a refresh token is valid for")
+	flag.StringVar(&cfg.tokens.format, "access-token-format", "opaque", "Format of issued access tokens (opaque|jwt)")
+	flag.Func("jwt-keys", "JWT signing and verification keys as id=path pairs (space separated)", func(val string) error {
+		cfg.tokens.jwtKeys = strings.Fields(val)
+		return nil
+	})
+	flag.StringVar(&cfg.tokens.jwtSigningKey, "jwt-signing-key", "", "ID of the key new JWTs are signed with (defaults to the first of jwt-keys)")
+
+	flag.StringVar(&cfg.totp.issuer, "totp-issuer", "Greenlight", "Issuer name shown in authenticator apps for two-factor authentication")
+
+	flag.IntVar(&cfg.login.maxFailures, "login-max-failures", 10, "Failed logins before an account is locked (0 disables)")
+	flag.IntVar(&cfg.login.maxIPFailures, "login-max-ip-failures", 100, "Failed logins before an IP address is locked (0 disables)")
+	flag.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", 15*time.Minute, "How long accounts and IP addresses are locked after too many failed logins")
+
 	flag.Parse()
 	// Initialize a new logger which writes messages to the standard out stream,
 	//prefixed with the current date and time.
@@ -105,6 +168,35 @@ func main() {
 		logger: logger,
 		models: data.NewModels(db),
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+
+		thumbnailSlots: make(chan struct{}, maxConcurrentThumbnails),
+	}
+
+	app.storage, err = storage.NewLocalStore(cfg.attachments.dir)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Opaque access tokens are looked up in the database on every request. JWTs are
+	// checked against their signature instead, so the keys are only needed for them.
+	switch cfg.tokens.format {
+	case "opaque":
+	case "jwt":
+		app.jwtKeys, err = loadJWTKeys(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	default:
+		logger.PrintFatal(fmt.Errorf("invalid access-token-format %q", cfg.tokens.format), nil)
+	}
+
+	// Price conversion is only available when an exchange rates file is configured.
+	if cfg.rates.file != "" {
+		provider, err := rates.NewFileProvider(cfg.rates.file, cfg.rates.checkInterval, logger)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		app.rates = provider
 	}
 
 	err = app.serve()
@@ -86,8 +86,45 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 		authorizationHeader := r.Header.Get("Authorization")
 
+		// Scripts and services authenticate with an API key instead of a token. A
+		// request carrying both is ambiguous, so it's rejected.
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			if authorizationHeader != "" {
+				app.invalidAPIKeyResponse(w, r)
+				return
+			}
+
+			v := validator.New()
+			if data.ValidateAPIKeyPlaintext(v, apiKey); !v.Valid() {
+				app.invalidAPIKeyResponse(w, r)
+				return
+			}
+
+			user, keyID, err := app.models.Users.GetForAPIKey(apiKey)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAPIKeyResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			err = app.models.APIKeys.Touch(keyID)
+			if err != nil {
+				app.logError(r, err)
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetAPIKeyID(r, keyID)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		if authorizationHeader == "" {
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
@@ -101,6 +138,23 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		token := headerParts[1]
+
+		// JWTs are told apart by the dots between their three parts, which can't
+		// appear in an opaque token. They're only accepted when JWT mode is enabled.
+		if app.jwtKeys != nil && strings.Contains(token, ".") {
+			user, sessionID, err := app.verifyJWTAccessToken(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetToken(r, token)
+			r = app.contextSetSessionID(r, sessionID)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
 			app.invalidAuthenticationTokenResponse(w, r)
@@ -117,12 +171,19 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Failing to record when the token was last used shouldn't fail the request.
+		err = app.models.Tokens.Touch(token)
+		if err != nil {
+			app.logError(r, err)
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
@@ -131,6 +192,14 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 			return
 		}
 
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAuthenticatedUser(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
 		if !user.Activated {
 			app.inactiveAccountResponse(w, r)
 			return
@@ -140,11 +209,23 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	})
 }
 
+// The requireUserCredentials() middleware refuses requests authenticated with an API
+// key, for endpoints such as managing sessions and API keys which only the user
+// themselves should be able to use.
+func (app *application) requireUserCredentials(next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAuthenticatedUser(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKeyID(r) != 0 {
+			app.errorResponse(w, r, http.StatusForbidden, "this resource can't be accessed with an API key")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	return app.requireActivatedUser(func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
-
-		permissions, err := app.models.Permissions.GetAllPermissionsForUser(user.ID)
+		permissions, err := app.requestPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -159,6 +240,28 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	})
 }
 
+// The userHasPermission() helper reports whether the user in the request context has
+// the given permission code, for handlers which change their behaviour based on it.
+func (app *application) userHasPermission(r *http.Request, code string) (bool, error) {
+	permissions, err := app.requestPermissions(r)
+	if err != nil {
+		return false, err
+	}
+
+	return permissions.Include(code), nil
+}
+
+// The requestPermissions() helper returns the permissions of the request's credentials:
+// those of the API key when one was used, and otherwise all of the user's.
+func (app *application) requestPermissions(r *http.Request) (data.Permissions, error) {
+	if keyID := app.contextGetAPIKeyID(r); keyID != 0 {
+		return app.models.Permissions.GetAllPermissionsForAPIKey(keyID)
+	}
+
+	user := app.contextGetUser(r)
+	return app.models.Permissions.GetAllPermissionsForUser(user.ID)
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Origin")
@@ -171,10 +274,11 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match, X-API-Key")
 
 						w.WriteHeader(http.StatusOK)
 						return
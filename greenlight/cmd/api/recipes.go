@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/rates"
+	"greenlight.dimash.net/internal/validator"
+	"net/http"
+	"strings"
+)
+
+// The recipeErrorResponse() method sends the response for the errors shared by the
+// create and update recipe endpoints, and reports whether it handled err.
+func (app *application) recipeErrorResponse(w http.ResponseWriter, r *http.Request, err error) bool {
+	v := validator.New()
+
+	switch {
+	case errors.Is(err, data.ErrInvalidRecipeMaterial):
+		v.AddError("materials", "must only contain existing crafting materials")
+	case errors.Is(err, data.ErrInvalidSubRecipe):
+		v.AddError("sub_recipes", "must only contain existing recipes")
+	case errors.Is(err, data.ErrRecipeCycle):
+		v.AddError("sub_recipes", "must not contain a recipe which contains this recipe")
+	default:
+		return false
+	}
+
+	app.failedValidationResponse(w, r, v.Errors)
+	return true
+}
+
+func (app *application) createRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name       string                  `json:"name"`
+		Materials  []data.MaterialQuantity `json:"materials"`
+		SubRecipes []data.RecipeQuantity   `json:"sub_recipes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	recipe := &data.Recipe{
+		Name:       input.Name,
+		Materials:  input.Materials,
+		SubRecipes: input.SubRecipes,
+	}
+
+	v := validator.New()
+	if data.ValidateRecipe(v, recipe); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Recipes.Insert(recipe)
+	if err != nil {
+		if !app.recipeErrorResponse(w, r, err) {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/recipes/%d", recipe.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"recipe": recipe}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	recipe, err := app.models.Recipes.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recipe": recipe}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	recipe, err := app.models.Recipes.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The materials and sub_recipes arrays, when given, replace the existing ones.
+	var input struct {
+		Name       *string                 `json:"name"`
+		Materials  []data.MaterialQuantity `json:"materials"`
+		SubRecipes []data.RecipeQuantity   `json:"sub_recipes"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		recipe.Name = *input.Name
+	}
+	if input.Materials != nil {
+		recipe.Materials = input.Materials
+	}
+	if input.SubRecipes != nil {
+		recipe.SubRecipes = input.SubRecipes
+	}
+
+	v := validator.New()
+	if data.ValidateRecipe(v, recipe); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Recipes.Update(recipe)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			if !app.recipeErrorResponse(w, r, err) {
+				app.serverErrorResponse(w, r, err)
+			}
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recipe": recipe}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Recipes.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrRecipeInUse):
+			app.errorResponse(w, r, http.StatusConflict, "the recipe is used as a sub-recipe of another recipe")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "recipe successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listRecipesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Name = app.readString(qs, "name", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "-id", "-name"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recipes, metadata, err := app.models.Recipes.GetAll(input.Name, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recipes": recipes, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recipeCostLine is the cost of one of the crafting materials in a recipe.
+type recipeCostLine struct {
+	*data.RecipeRequirement
+	Subtotal data.Price `json:"subtotal"`
+}
+
+// The showRecipeCostHandler() computes the cost of crafting a recipe from the current
+// price of every crafting material it needs, including those of its sub-recipes. The
+// cost is given in the currency query string parameter, which defaults to the currency
+// of the materials when they all share one and to USD otherwise.
+func (app *application) showRecipeCostHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	currency := strings.ToUpper(app.readString(r.URL.Query(), "currency", ""))
+	if currency != "" {
+		if v.Check(data.ValidCurrency(currency), "currency", "must be a supported currency"); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	_, err = app.models.Recipes.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	requirements, err := app.models.Recipes.Requirements(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQuantityOutOfRange):
+			app.recipeCostOutOfRangeResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if currency == "" {
+		currency = data.DefaultCurrency
+		if len(requirements) > 0 {
+			currency = requirements[0].UnitPrice.Currency
+		}
+		for _, requirement := range requirements {
+			if requirement.UnitPrice.Currency != currency {
+				currency = data.DefaultCurrency
+				break
+			}
+		}
+	}
+
+	lines := make([]recipeCostLine, len(requirements))
+	total := data.Price{Currency: currency}
+
+	for i, requirement := range requirements {
+		subtotal, err := requirement.UnitPrice.Multiply(requirement.Quantity)
+		if err != nil {
+			app.recipeCostOutOfRangeResponse(w, r)
+			return
+		}
+
+		if subtotal.Currency != currency {
+			if app.rates == nil {
+				v.AddError("currency", "price conversion is not available")
+				app.failedValidationResponse(w, r, v.Errors)
+				return
+			}
+
+			rate, err := app.rates.Rate(subtotal.Currency, currency)
+			if err != nil {
+				switch {
+				case errors.Is(err, rates.ErrUnknownCurrency):
+					v.AddError("currency", err.Error())
+					app.failedValidationResponse(w, r, v.Errors)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			subtotal, err = subtotal.Convert(currency, rate)
+			if err != nil {
+				app.recipeCostOutOfRangeResponse(w, r)
+				return
+			}
+		}
+
+		lines[i] = recipeCostLine{RecipeRequirement: requirement, Subtotal: subtotal}
+
+		total, err = total.Add(subtotal)
+		if err != nil {
+			app.recipeCostOutOfRangeResponse(w, r)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"cost": envelope{"total": total, "materials": lines}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The recipeCostOutOfRangeResponse() method is sent when a recipe's quantities or cost
+// are too large to calculate.
+func (app *application) recipeCostOutOfRangeResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, "the recipe's cost is too large to calculate")
+}
+
+// The listCraftableRecipesHandler() answers "what can I craft with this inventory": it
+// returns each recipe which can be crafted at least once from the crafting materials
+// in the request body, along with how many times.
+func (app *application) listCraftableRecipesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Inventory []data.MaterialQuantity `json:"inventory"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Inventory) > 0, "inventory", "must contain at least 1 item")
+	if data.ValidateMaterialQuantities(v, "inventory", input.Inventory); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recipes, err := app.models.Recipes.Craftable(input.Inventory)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recipes": recipes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
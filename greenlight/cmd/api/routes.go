@@ -22,13 +22,84 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/crafting_materials/:id", app.requirePermission("craftingmaterials:read", app.showCraftingMaterialHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/crafting_materials/:id", app.requirePermission("craftingmaterials:write", app.updateCraftingMaterialHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/crafting_materials/:id", app.requirePermission("craftingmaterials:write", app.deleteCraftingMaterialHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/crafting_materials/:id/restore", app.requirePermission("craftingmaterials:write", app.restoreCraftingMaterialHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/crafting_materials/:id/history", app.requirePermission("craftingmaterials:read", app.showCraftingMaterialHistoryHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/crafting_materials/:id/revert", app.requirePermission("craftingmaterials:write", app.revertCraftingMaterialHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/crafting_materials/:id/attachments", app.requirePermission("craftingmaterials:read", app.listAttachmentsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/crafting_materials/:id/attachments", app.requirePermission("craftingmaterials:write", app.uploadAttachmentHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/crafting_materials/:id/attachments/:attachment_id", app.requirePermission("craftingmaterials:read", app.downloadAttachmentHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/crafting_materials/:id/attachments/:attachment_id", app.requirePermission("craftingmaterials:write", app.deleteAttachmentHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/crafting_materials/:id/attachments/:attachment_id/thumbnail", app.requirePermission("craftingmaterials:read", app.downloadAttachmentThumbnailHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
+	// httprouter doesn't allow a static segment next to the :id wildcard, so the bulk,
+	// export and import endpoints live under their own prefixes.
+	router.HandlerFunc(http.MethodPost, "/v1/bulk/crafting_materials", app.requirePermission("craftingmaterials:write", app.bulkCreateCraftingMaterialsHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/bulk/crafting_materials", app.requirePermission("craftingmaterials:write", app.bulkUpdateCraftingMaterialsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/bulk/crafting_materials", app.requirePermission("craftingmaterials:write", app.bulkDeleteCraftingMaterialsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/export/crafting_materials", app.requirePermission("craftingmaterials:read", app.exportCraftingMaterialsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/import/crafting_materials", app.requirePermission("craftingmaterials:write", app.importCraftingMaterialsHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/categories", app.requirePermission("craftingmaterials:read", app.listCategoriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/categories", app.requirePermission("craftingmaterials:write", app.createCategoryHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/categories/:id", app.requirePermission("craftingmaterials:read", app.showCategoryHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/categories/:id", app.requirePermission("craftingmaterials:write", app.updateCategoryHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/categories/:id", app.requirePermission("craftingmaterials:write", app.deleteCategoryHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/tags", app.requirePermission("craftingmaterials:read", app.listTagsHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/tags/:tag", app.requirePermission("craftingmaterials:write", app.renameTagHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tags/:tag", app.requirePermission("craftingmaterials:write", app.deleteTagHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/recipes", app.requirePermission("recipes:read", app.listRecipesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/recipes", app.requirePermission("recipes:write", app.createRecipeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/recipes/:id", app.requirePermission("recipes:read", app.showRecipeHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/recipes/:id", app.requirePermission("recipes:write", app.updateRecipeHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/recipes/:id", app.requirePermission("recipes:write", app.deleteRecipeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/recipes/:id/cost", app.requirePermission("recipes:read", app.showRecipeCostHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/craftable_recipes", app.requirePermission("recipes:read", app.listCraftableRecipesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireUserCredentials(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication/totp", app.createTwoFactorAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireUserCredentials(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireUserCredentials(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireUserCredentials(app.deleteSessionHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api_keys", app.requireUserCredentials(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api_keys", app.requireUserCredentials(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api_keys/:id", app.requireUserCredentials(app.deleteAPIKeyHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/totp", app.requireUserCredentials(app.showTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireUserCredentials(app.createTOTPHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireUserCredentials(app.deleteTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp/enable", app.requireUserCredentials(app.enableTOTPHandler))
+
+	// httprouter doesn't allow a wildcard next to /v1/users/activated and the other
+	// static routes, so admin endpoints for a user live under their own prefix.
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/unlock", app.requirePermission("users:admin", app.unlockUserHandler))
+
+	// The inventory belongs to the authenticated user, so changing it doesn't need
+	// write access to the crafting materials themselves, but it has its own write
+	// permission so that it can be withheld from read-only clients.
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/inventory", app.requirePermission("craftingmaterials:read", app.listInventoryHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/inventory/:id", app.requirePermission("craftingmaterials:read", app.showInventoryItemHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/inventory/:id", app.requirePermission("inventory:write", app.setInventoryItemHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/inventory/:id", app.requirePermission("inventory:write", app.deleteInventoryItemHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/inventory/:id/increment", app.requirePermission("inventory:write", app.incrementInventoryItemHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/inventory/:id/decrement", app.requirePermission("inventory:write", app.decrementInventoryItemHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/craftable_recipes", app.requirePermission("recipes:read", app.listCraftableFromInventoryHandler))
 
 	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
 }
@@ -26,6 +26,14 @@ func (app *application) serve() error {
 	// Start a background goroutine.
 	shutdownError := make(chan error)
 
+	// Start the periodic clean up tasks, which stop when purgeDone is closed.
+	purgeDone := make(chan struct{})
+	if app.config.purge.retention > 0 {
+		app.periodically(purgeDone, app.config.purge.interval, app.purgeDeletedCraftingMaterials)
+	}
+	app.periodically(purgeDone, app.config.purge.interval, app.purgeExpiredTokens)
+	app.periodically(purgeDone, app.config.purge.interval, app.purgeLoginThrottles)
+
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -42,6 +50,7 @@ func (app *application) serve() error {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
+		close(purgeDone)
 		app.wg.Wait()
 		shutdownError <- srv.Shutdown(ctx)
 	}()
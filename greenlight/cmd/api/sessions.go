@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"greenlight.dimash.net/internal/data"
+	"net/http"
+	"strconv"
+)
+
+// The listSessionsHandler() returns the authenticated user's active sessions, one for
+// each login which can still be refreshed, so that they can spot and revoke any they
+// don't recognise.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// JWTs aren't stored, so the current session is found from the id in the token.
+	if sessionID := app.contextGetSessionID(r); sessionID != 0 {
+		for _, session := range sessions {
+			session.Current = session.ID == sessionID
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeExpiredTokens deletes expired tokens, and sessions which can no longer be
+// refreshed. It is run periodically by serve().
+func (app *application) purgeExpiredTokens() {
+	tokens, sessions, err := app.models.Tokens.DeleteExpired()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if tokens > 0 || sessions > 0 {
+		app.logger.PrintInfo("purged expired tokens", map[string]string{
+			"tokens":   strconv.FormatInt(tokens, 10),
+			"sessions": strconv.FormatInt(sessions, 10),
+		})
+	}
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Tokens.DeleteSession(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/validator"
+	"net/http"
+)
+
+// The readTagParam() helper returns the normalized "tag" URL parameter.
+func (app *application) readTagParam(r *http.Request) string {
+	params := httprouter.ParamsFromContext(r.Context())
+	return data.NormalizeTag(params.ByName("tag"))
+}
+
+func (app *application) listTagsHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := app.models.CraftingMaterials.Tags()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"tags": tags}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The renameTagHandler() replaces a tag on every crafting material which carries it.
+// Renaming to a tag which is already in use merges the two.
+func (app *application) renameTagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := app.readTagParam(r)
+
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	name := data.NormalizeTag(input.Name)
+
+	v := validator.New()
+	if data.ValidateTag(v, "name", name); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	updated, err := app.models.CraftingMaterials.RenameTag(tag, name, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"tag": data.Tag{Name: name, Count: int(updated)}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := app.models.CraftingMaterials.RemoveTag(app.readTagParam(r), app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "tag successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
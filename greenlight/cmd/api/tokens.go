@@ -5,6 +5,7 @@ import (
 	"greenlight.dimash.net/internal/data"
 	"greenlight.dimash.net/internal/validator"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -29,10 +30,32 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Failed logins are counted per account and per IP address, and each failure
+	// makes the client wait longer before the next attempt, until it's locked out.
+	// The attempt is counted before the password is checked, and handed back if it's
+	// right, so that concurrent guesses can't get past the wait.
+	throttleKeys, err := app.loginThrottleKeys(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	throttles, retryAfter, err := app.reserveLoginAttempt(throttleKeys)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			app.loginFailed(throttleKeys, throttles, nil)
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -47,17 +70,384 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		app.loginFailed(throttleKeys, throttles, user)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	// Users with two-factor authentication turned on get a short-lived token instead,
+	// which is exchanged for the real tokens along with a code from their
+	// authenticator app.
+	totpEnabled, err := app.models.TOTP.Enabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if totpEnabled {
+		// The account's failures are only cleared once the second factor is right too,
+		// so that knowing the password isn't enough to keep guessing codes.
+		err = app.releaseLoginAttempt(throttleKeys)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTwoFactor)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{"two_factor_token": token, "message": "a two-factor authentication code is required to complete the login"}
+
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.loginSucceeded(throttleKeys)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.createSession(w, r, user)
+}
+
+// The createSession() method logs the user in, sending a response with a new
+// authentication token and refresh token.
+func (app *application) createSession(w http.ResponseWriter, r *http.Request, user *data.User) {
+	// The authentication token is short-lived, so that a leaked one is only useful
+	// for a few minutes. The refresh token is used to get a new one when it expires.
+	accessToken, refreshToken, err := app.models.Tokens.NewSession(user.ID, r.UserAgent(), app.accessTokenTTL(), app.config.tokens.refreshTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.jwtKeys != nil {
+		accessToken, err = app.newJWTAccessToken(user, refreshToken)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelope{"authentication_token": accessToken, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createTwoFactorAuthenticationTokenHandler() is the second step of logging in for
+// users with two-factor authentication turned on. It takes the token from the first
+// step along with either a code from the user's authenticator app or one of their
+// recovery codes. The token is revoked on the first attempt, whether or not the code is
+// right, so that codes can't be guessed without also knowing the password.
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	validateSecondFactor(v, input.Code, input.RecoveryCode)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTwoFactor, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The code is counted against the same keys as the password was, so that a wrong
+	// code is a failed login like a wrong password.
+	throttleKeys, err := app.loginThrottleKeys(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	throttles, retryAfter, err := app.reserveLoginAttempt(throttleKeys)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ok, err := app.checkSecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.loginFailed(throttleKeys, throttles, user)
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	err = app.loginSucceeded(throttleKeys)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	app.createSession(w, r, user)
+}
+
+// The refreshAuthenticationTokenHandler() exchanges a refresh token for a new
+// authentication token and refresh token. Each refresh token can only be used once; if
+// one is used again it has been stolen, or the client is misbehaving, and the session
+// it belongs to is revoked.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	accessToken, refreshToken, err := app.models.Tokens.Refresh(input.TokenPlaintext, app.accessTokenTTL(), app.config.tokens.refreshTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.PrintInfo("refresh token reused, session revoked", map[string]string{
+				"remote_addr": r.RemoteAddr,
+			})
+			v.AddError("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.jwtKeys != nil {
+		// The user is read again so that the new JWT reflects their current state,
+		// such as having activated their account since the last one was issued.
+		user, err := app.models.Users.Get(refreshToken.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		accessToken, err = app.newJWTAccessToken(user, refreshToken)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelope{"authentication_token": accessToken, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAuthenticationTokenHandler() logs out the current session by revoking the
+// authentication token the request was made with, and the refresh token issued with it.
+// A JWT can't be revoked, so when the request was made with one only its refresh token
+// is, and the JWT stays valid until it expires.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if sessionID := app.contextGetSessionID(r); sessionID != 0 {
+		err = app.models.Tokens.DeleteSession(app.contextGetUser(r).ID, sessionID)
+	} else {
+		err = app.models.Tokens.DeleteSessionForToken(app.contextGetToken(r))
+	}
+	if err != nil {
+		switch {
+		// The token may have been revoked by a concurrent request since it was checked.
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAllAuthenticationTokensHandler() logs out every session of the
+// authenticated user, including the current one.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.DeleteAllSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all sessions have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createPasswordResetTokenHandler() emails a password reset token to the owner of
+// an activated account. The response is the same whether or not such an account exists,
+// so that it can't be used to find out which email addresses are registered.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(strings.ToLower(input.Email))
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]interface{}{
+				"passwordResetToken": token.Plaintext,
+			}
+
+			err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	env := envelope{"message": "if an activated account with that email address exists, an email will be sent to it containing password reset instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createActivationTokenHandler() replaces a user's activation token and sends the
+// welcome email again, for users whose original email never arrived or whose token has
+// expired. As with password resets, the response doesn't reveal whether an account
+// with the email address exists or has already been activated.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(strings.ToLower(input.Email))
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && !user.Activated {
+		// Only the newest activation token should work.
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			info := map[string]interface{}{
+				"activationToken": token.Plaintext,
+				"userID":          user.ID,
+			}
+
+			err := app.mailer.Send(user.Email, "user_welcome.tmpl", info)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	env := envelope{"message": "if an account with that email address is awaiting activation, an email will be sent to it containing activation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
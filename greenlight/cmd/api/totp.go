@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"greenlight.dimash.net/internal/data"
+	"greenlight.dimash.net/internal/totp"
+	"greenlight.dimash.net/internal/validator"
+	"net/http"
+	"time"
+)
+
+// The validateSecondFactor() function checks that exactly one of a TOTP code and a
+// recovery code was given.
+func validateSecondFactor(v *validator.Validator, code, recoveryCode string) {
+	v.Check(code != "" || recoveryCode != "", "code", "must be provided")
+	v.Check(code == "" || recoveryCode == "", "recovery_code", "must not be provided along with code")
+}
+
+// The checkSecondFactor() method reports whether code is currently valid for the user's
+// authenticator app or, if no code is given, whether recoveryCode is one of their
+// unused recovery codes. Either is used up by a successful check.
+func (app *application) checkSecondFactor(userID int64, code, recoveryCode string) (bool, error) {
+	if code == "" {
+		err := app.models.TOTP.UseRecoveryCode(userID, recoveryCode)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	t, err := app.models.TOTP.Get(userID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	counter, ok := totp.Validate(t.Secret, code, time.Now())
+	if !ok || !t.Enabled() {
+		return false, nil
+	}
+
+	err = app.models.TOTP.UseCounter(userID, counter)
+	if err != nil {
+		if errors.Is(err, data.ErrTOTPCodeReused) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (app *application) showTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	enabled, err := app.models.TOTP.Enabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	remaining := 0
+	if enabled {
+		remaining, err = app.models.TOTP.RecoveryCodesRemaining(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelope{"two_factor": envelope{"enabled": enabled, "recovery_codes_remaining": remaining}}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createTOTPHandler() starts enrolment in two-factor authentication. It returns a
+// new secret and its provisioning URI, for the user to add to their authenticator app.
+// Two-factor authentication isn't turned on until enableTOTPHandler() has been sent a
+// code generated from the secret.
+func (app *application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	// The user is read again, as the one in the request context may have come from a
+	// JWT and so not have an email address.
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.SetPending(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPAlreadyEnabled):
+			app.totpAlreadyEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"two_factor": envelope{
+		"secret":           secret,
+		"provisioning_uri": totp.URI(app.config.totp.issuer, user.Email, secret),
+	}}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The enableTOTPHandler() turns on two-factor authentication once the user has shown
+// that their authenticator app generates valid codes. It returns the user's recovery
+// codes, which can each be used once instead of a code, and are never shown again.
+func (app *application) enableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	t, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.errorResponse(w, r, http.StatusConflict, "two-factor authentication enrolment hasn't been started")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if t.Enabled() {
+		app.totpAlreadyEnabledResponse(w, r)
+		return
+	}
+
+	counter, ok := totp.Validate(t.Secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "is not valid")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, hashes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Enable(user.ID, counter, hashes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPAlreadyEnabled):
+			app.totpAlreadyEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"recovery_codes": codes}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteTOTPHandler() turns off two-factor authentication. It needs a current code
+// or a recovery code, so that someone who has only got hold of an authentication token
+// can't turn it off.
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if validateSecondFactor(v, input.Code, input.RecoveryCode); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	enabled, err := app.models.TOTP.Enabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !enabled {
+		app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is not enabled")
+		return
+	}
+
+	ok, err := app.checkSecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		v.AddError("code", "is not valid")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.TOTP.Disable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) totpAlreadyEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+}
@@ -3,13 +3,11 @@ module greenlight.dimash.net
 go 1.20
 
 require (
+	github.com/go-mail/mail/v2 v2.3.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.14.0
+	golang.org/x/time v0.4.0
 )
 
-require (
-	github.com/go-mail/mail/v2 v2.3.0 // indirect
-	golang.org/x/crypto v0.14.0 // indirect
-	golang.org/x/time v0.4.0 // indirect
-	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
-)
+require gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
@@ -0,0 +1,244 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"greenlight.dimash.net/internal/validator"
+	"strings"
+	"time"
+)
+
+var ErrInvalidPermission = errors.New("invalid permission")
+
+// API keys are "gl_" followed by 32 random bytes in unpadded base32. The prefix makes
+// them easy to spot, for example by secret scanners, and the first few characters are
+// kept in plaintext so that their owners can tell them apart.
+const (
+	apiKeyPrefix       = "gl_"
+	apiKeyLength       = len(apiKeyPrefix) + 52
+	apiKeyPrefixLength = len(apiKeyPrefix) + 8
+)
+
+// API keys expire after DefaultAPIKeyTTLDays unless another lifetime is asked for, and
+// can't be made to last longer than MaxAPIKeyTTLDays.
+const (
+	DefaultAPIKeyTTLDays = 90
+	MaxAPIKeyTTLDays     = 365
+)
+
+// APIKey is a long-lived credential for scripts and services, which grants a subset of
+// its owner's permissions. The key itself is only known when it's created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Permissions Permissions `json:"permissions"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	ExpiresAt   time.Time   `json:"expires_at"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	v.Check(key.ExpiresAt.After(time.Now()), "expires_in_days", "must be greater than zero")
+	v.Check(!key.ExpiresAt.After(time.Now().AddDate(0, 0, MaxAPIKeyTTLDays)), "expires_in_days", "must not be more than 365")
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(keyPlaintext, apiKeyPrefix), "key", "must start with "+apiKeyPrefix)
+	v.Check(len(keyPlaintext) == apiKeyLength, "key", "must be 55 bytes long")
+}
+
+func generateAPIKey(key *APIKey) error {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	key.Plaintext = apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.Plaintext[:apiKeyPrefixLength]
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return nil
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Insert generates a new API key and stores it. Every permission must be one the user
+// holds, otherwise nothing is stored and ErrInvalidPermission is returned.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	err := generateAPIKey(key)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO api_keys (user_id, name, prefix, hash, expires_at)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at`
+
+	err = tx.QueryRowContext(ctx, query, key.UserID, key.Name, key.Prefix, key.Hash, key.ExpiresAt).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `
+	INSERT INTO api_keys_permissions (api_key_id, permission_id)
+	SELECT $1, permissions.id
+	FROM permissions
+	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+	WHERE users_permissions.user_id = $2 AND permissions.code = ANY($3)`
+
+	result, err := tx.ExecContext(ctx, query, key.ID, key.UserID, pq.Array(key.Permissions))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected != int64(len(key.Permissions)) {
+		return ErrInvalidPermission
+	}
+
+	return tx.Commit()
+}
+
+// GetAllForUser returns the user's API keys, oldest first, without their plaintext.
+// Expired keys are included, so that their owners can see why they stopped working.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+	SELECT k.id, k.created_at, k.name, k.prefix, k.last_used_at, k.expires_at,
+		COALESCE(array_agg(p.code ORDER BY p.code) FILTER (WHERE p.code IS NOT NULL), '{}')
+	FROM api_keys k
+	LEFT JOIN api_keys_permissions kp ON kp.api_key_id = k.id
+	LEFT JOIN permissions p ON p.id = kp.permission_id
+	WHERE k.user_id = $1
+	GROUP BY k.id
+	ORDER BY k.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		key := APIKey{UserID: userID}
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.Name,
+			&key.Prefix,
+			&key.LastUsedAt,
+			&key.ExpiresAt,
+			pq.Array((*[]string)(&key.Permissions)),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Delete revokes one of the user's API keys.
+func (m APIKeyModel) Delete(userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	DELETE FROM api_keys
+	WHERE user_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser revokes all of the user's API keys.
+func (m APIKeyModel) DeleteAllForUser(userID int64) error {
+	query := `
+	DELETE FROM api_keys
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Touch records that an API key has just been used. As with TokenModel.Touch() the
+// time is only updated once a minute.
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+	UPDATE api_keys
+	SET last_used_at = NOW()
+	WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - interval '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
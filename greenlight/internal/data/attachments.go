@@ -0,0 +1,163 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Attachment is a file, such as a photo or a spec sheet, uploaded for a crafting
+// material. The file itself lives in storage under StorageKey, and ThumbnailKey is set
+// for images which a thumbnail could be generated for.
+type Attachment struct {
+	ID                 int64     `json:"id"`
+	CraftingMaterialID int64     `json:"crafting_material_id"`
+	CreatedAt          time.Time `json:"created_at"`
+	Filename           string    `json:"filename"`
+	ContentType        string    `json:"content_type"`
+	Size               int64     `json:"size"`
+	HasThumbnail       bool      `json:"has_thumbnail"`
+	StorageKey         string    `json:"-"`
+	ThumbnailKey       *string   `json:"-"`
+}
+
+type AttachmentModel struct {
+	DB *sql.DB
+}
+
+func (m AttachmentModel) Insert(attachment *Attachment) error {
+	query := `
+	INSERT INTO craftingmaterial_attachments (crafting_material_id, filename, content_type, size, storage_key, thumbnail_key)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+
+	args := []interface{}{
+		attachment.CraftingMaterialID,
+		attachment.Filename,
+		attachment.ContentType,
+		attachment.Size,
+		attachment.StorageKey,
+		attachment.ThumbnailKey,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&attachment.ID, &attachment.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	attachment.HasThumbnail = attachment.ThumbnailKey != nil
+	return nil
+}
+
+func (m AttachmentModel) Get(materialID, id int64) (*Attachment, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, crafting_material_id, created_at, filename, content_type, size, storage_key, thumbnail_key
+	FROM craftingmaterial_attachments
+	WHERE crafting_material_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	attachment, err := scanAttachment(m.DB.QueryRowContext(ctx, query, materialID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return attachment, nil
+}
+
+func (m AttachmentModel) GetAllForCraftingMaterial(materialID int64) ([]*Attachment, error) {
+	query := `
+	SELECT id, crafting_material_id, created_at, filename, content_type, size, storage_key, thumbnail_key
+	FROM craftingmaterial_attachments
+	WHERE crafting_material_id = $1
+	ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, materialID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []*Attachment{}
+
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// Delete removes an attachment record and returns it, so that the caller can remove
+// its files from storage.
+func (m AttachmentModel) Delete(materialID, id int64) (*Attachment, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	DELETE FROM craftingmaterial_attachments
+	WHERE crafting_material_id = $1 AND id = $2
+	RETURNING id, crafting_material_id, created_at, filename, content_type, size, storage_key, thumbnail_key`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	attachment, err := scanAttachment(m.DB.QueryRowContext(ctx, query, materialID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return attachment, nil
+}
+
+func scanAttachment(row interface{ Scan(...interface{}) error }) (*Attachment, error) {
+	var attachment Attachment
+
+	err := row.Scan(
+		&attachment.ID,
+		&attachment.CraftingMaterialID,
+		&attachment.CreatedAt,
+		&attachment.Filename,
+		&attachment.ContentType,
+		&attachment.Size,
+		&attachment.StorageKey,
+		&attachment.ThumbnailKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	attachment.HasThumbnail = attachment.ThumbnailKey != nil
+	return &attachment, nil
+}
@@ -0,0 +1,330 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.dimash.net/internal/validator"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCategory = errors.New("category does not exist")
+	ErrCategoryCycle   = errors.New("category cannot be moved below itself")
+	ErrCategoryInUse   = errors.New("category has subcategories or crafting materials")
+)
+
+// Category is a node in the crafting material category tree. Path holds the names of
+// the category's ancestors followed by its own name, starting from the root.
+type Category struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"name"`
+	ParentID  *int64    `json:"parent_id,omitempty"`
+	Path      []string  `json:"path"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateCategory(v *validator.Validator, category *Category) {
+	v.Check(category.Name != "", "name", "must be provided")
+	v.Check(len(category.Name) <= 100, "name", "must not be more than 100 bytes long")
+	if category.ParentID != nil {
+		v.Check(*category.ParentID > 0, "parent_id", "must be a positive integer")
+		v.Check(*category.ParentID != category.ID, "parent_id", "must not be the category itself")
+	}
+}
+
+// categoryPathSQL returns a scalar subquery which evaluates to the path of names from
+// the root of the tree down to the category whose id is in the given column, or NULL if
+// the column is NULL.
+func categoryPathSQL(column string) string {
+	return fmt.Sprintf(`(
+		WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id, name, 1 AS depth FROM categories WHERE id = %s
+			UNION ALL
+			SELECT c.id, c.parent_id, c.name, a.depth + 1
+			FROM categories c JOIN ancestors a ON c.id = a.parent_id
+		)
+		SELECT array_agg(name ORDER BY depth DESC) FROM ancestors
+	)`, column)
+}
+
+// categorySubtreeSQL returns a subquery which selects the id of the category in the
+// given placeholder and the ids of all of its descendants.
+func categorySubtreeSQL(placeholder string) string {
+	return fmt.Sprintf(`(
+		WITH RECURSIVE subtree AS (
+			SELECT id FROM categories WHERE id = %s
+			UNION ALL
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT id FROM subtree
+	)`, placeholder)
+}
+
+func isForeignKeyViolation(err error) bool {
+	return strings.HasPrefix(err.Error(), "pq: ") && strings.Contains(err.Error(), "violates foreign key constraint")
+}
+
+type CategoryModel struct {
+	DB *sql.DB
+}
+
+// categoryPath reads the path of a category inside the transaction which has just
+// written it. It can't be read in the RETURNING clause of the write, because the
+// subquery there sees the table as it was before the statement ran.
+func categoryPath(ctx context.Context, tx *sql.Tx, category *Category) error {
+	query := fmt.Sprintf(`SELECT %s`, categoryPathSQL("$1"))
+
+	return tx.QueryRowContext(ctx, query, category.ID).Scan(pq.Array(&category.Path))
+}
+
+func (m CategoryModel) Insert(category *Category) error {
+	query := `
+	INSERT INTO categories (name, parent_id)
+	VALUES ($1, $2)
+	RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, category.Name, category.ParentID).Scan(
+		&category.ID,
+		&category.CreatedAt,
+		&category.Version,
+	)
+	if err != nil {
+		switch {
+		case isForeignKeyViolation(err):
+			return ErrInvalidCategory
+		default:
+			return err
+		}
+	}
+
+	err = categoryPath(ctx, tx, category)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m CategoryModel) Get(id int64) (*Category, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+	SELECT id, created_at, name, parent_id, version, %s
+	FROM categories
+	WHERE id = $1`, categoryPathSQL("categories.id"))
+
+	var category Category
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&category.ID,
+		&category.CreatedAt,
+		&category.Name,
+		&category.ParentID,
+		&category.Version,
+		pq.Array(&category.Path),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &category, nil
+}
+
+// GetAll returns every category, ordered by path so that each category directly follows
+// its parent.
+func (m CategoryModel) GetAll() ([]*Category, error) {
+	query := fmt.Sprintf(`
+	SELECT id, created_at, name, parent_id, version, %s AS path
+	FROM categories
+	ORDER BY path, id`, categoryPathSQL("categories.id"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []*Category{}
+
+	for rows.Next() {
+		var category Category
+
+		err := rows.Scan(
+			&category.ID,
+			&category.CreatedAt,
+			&category.Name,
+			&category.ParentID,
+			&category.Version,
+			pq.Array(&category.Path),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		categories = append(categories, &category)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return categories, nil
+}
+
+// Update renames or moves a category. Moving a category below itself or one of its own
+// descendants returns ErrCategoryCycle.
+func (m CategoryModel) Update(category *Category) error {
+	cycleQuery := fmt.Sprintf(`
+	SELECT EXISTS (SELECT 1 FROM %s AS subtree WHERE id = $2)`, categorySubtreeSQL("$1"))
+
+	query := `
+	UPDATE categories
+	SET name = $1, parent_id = $2, version = version + 1
+	WHERE id = $3 AND version = $4
+	RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Stop the tree from being changed by another request between the cycle check and
+	// the update, while still allowing it to be read.
+	_, err = tx.ExecContext(ctx, "LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE")
+	if err != nil {
+		return err
+	}
+
+	if category.ParentID != nil {
+		var cycle bool
+		err = tx.QueryRowContext(ctx, cycleQuery, category.ID, *category.ParentID).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrCategoryCycle
+		}
+	}
+
+	args := []interface{}{category.Name, category.ParentID, category.ID, category.Version}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&category.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case isForeignKeyViolation(err):
+			return ErrInvalidCategory
+		default:
+			return err
+		}
+	}
+
+	err = categoryPath(ctx, tx, category)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a category. Categories which still have subcategories or crafting
+// materials (including soft deleted ones) cannot be deleted and return
+// ErrCategoryInUse.
+func (m CategoryModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	DELETE FROM categories
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		switch {
+		case isForeignKeyViolation(err):
+			return ErrCategoryInUse
+		default:
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Exist returns the subset of the given ids which belong to existing categories.
+func (m CategoryModel) Exist(ids []int64) (map[int64]bool, error) {
+	query := `
+	SELECT id
+	FROM categories
+	WHERE id = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[int64]bool)
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return existing, nil
+}
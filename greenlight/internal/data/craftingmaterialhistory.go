@@ -0,0 +1,210 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// The actions recorded in the crafting material history.
+const (
+	HistoryActionInsert  = "insert"
+	HistoryActionUpdate  = "update"
+	HistoryActionDelete  = "delete"
+	HistoryActionRestore = "restore"
+	HistoryActionRevert  = "revert"
+)
+
+// CraftingMaterialSnapshot holds the editable values of a crafting material at a point
+// in time.
+type CraftingMaterialSnapshot struct {
+	Title      string   `json:"title"`
+	Year       int32    `json:"year"`
+	Price      Price    `json:"price"`
+	CategoryID *int64   `json:"category_id,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+func (material *CraftingMaterials) Snapshot() *CraftingMaterialSnapshot {
+	return &CraftingMaterialSnapshot{
+		Title:      material.Title,
+		Year:       material.Year,
+		Price:      material.Price,
+		CategoryID: material.CategoryID,
+		Tags:       material.Tags,
+	}
+}
+
+// Apply copies the values in the snapshot onto the crafting material.
+func (snapshot *CraftingMaterialSnapshot) Apply(material *CraftingMaterials) {
+	material.Title = snapshot.Title
+	material.Year = snapshot.Year
+	material.Price = snapshot.Price
+	material.CategoryID = snapshot.CategoryID
+	material.Tags = snapshot.Tags
+}
+
+// CraftingMaterialRevision is a single entry in the history of a crafting material.
+// Version is the version of the crafting material after the change. OldValues is nil
+// for inserts and NewValues is nil for deletes. UserID is nil if the acting user has
+// since been deleted.
+type CraftingMaterialRevision struct {
+	ID                 int64                     `json:"id"`
+	CraftingMaterialID int64                     `json:"crafting_material_id"`
+	Version            int32                     `json:"version"`
+	Action             string                    `json:"action"`
+	UserID             *int64                    `json:"user_id"`
+	ChangedAt          time.Time                 `json:"changed_at"`
+	OldValues          *CraftingMaterialSnapshot `json:"old_values,omitempty"`
+	NewValues          *CraftingMaterialSnapshot `json:"new_values,omitempty"`
+}
+
+type CraftingMaterialHistoryModel struct {
+	DB *sql.DB
+}
+
+// insertRevision records a change to a crafting material as part of the transaction
+// which made it, so that the change and its history are saved or rolled back together.
+func insertRevision(ctx context.Context, tx *sql.Tx, revision *CraftingMaterialRevision) error {
+	query := `
+	INSERT INTO craftingmaterials_history (crafting_material_id, version, action, user_id, old_values, new_values)
+	VALUES ($1, $2, $3, $4, $5::jsonb, $6::jsonb)
+	RETURNING id, changed_at`
+
+	oldValues, err := snapshotJSON(revision.OldValues)
+	if err != nil {
+		return err
+	}
+
+	newValues, err := snapshotJSON(revision.NewValues)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{
+		revision.CraftingMaterialID,
+		revision.Version,
+		revision.Action,
+		revision.UserID,
+		oldValues,
+		newValues,
+	}
+
+	return tx.QueryRowContext(ctx, query, args...).Scan(&revision.ID, &revision.ChangedAt)
+}
+
+// GetAllForCraftingMaterial returns the history of a crafting material, oldest first.
+func (m CraftingMaterialHistoryModel) GetAllForCraftingMaterial(materialID int64) ([]*CraftingMaterialRevision, error) {
+	query := `
+	SELECT id, crafting_material_id, version, action, user_id, changed_at, old_values, new_values
+	FROM craftingmaterials_history
+	WHERE crafting_material_id = $1
+	ORDER BY id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, materialID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*CraftingMaterialRevision{}
+
+	for rows.Next() {
+		revision, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// GetVersion returns the revision which produced the given version of a crafting
+// material. Only revisions which left the crafting material with values (that is,
+// anything other than a delete) are considered.
+func (m CraftingMaterialHistoryModel) GetVersion(materialID int64, version int32) (*CraftingMaterialRevision, error) {
+	query := `
+	SELECT id, crafting_material_id, version, action, user_id, changed_at, old_values, new_values
+	FROM craftingmaterials_history
+	WHERE crafting_material_id = $1 AND version = $2 AND new_values IS NOT NULL
+	ORDER BY id DESC
+	LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	revision, err := scanRevision(m.DB.QueryRowContext(ctx, query, materialID, version))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return revision, nil
+}
+
+func snapshotJSON(snapshot *CraftingMaterialSnapshot) (interface{}, error) {
+	if snapshot == nil {
+		return nil, nil
+	}
+
+	js, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(js), nil
+}
+
+// scanRevision scans a history row from either *sql.Row or *sql.Rows.
+func scanRevision(row interface{ Scan(...interface{}) error }) (*CraftingMaterialRevision, error) {
+	var (
+		revision  CraftingMaterialRevision
+		oldValues []byte
+		newValues []byte
+	)
+
+	err := row.Scan(
+		&revision.ID,
+		&revision.CraftingMaterialID,
+		&revision.Version,
+		&revision.Action,
+		&revision.UserID,
+		&revision.ChangedAt,
+		&oldValues,
+		&newValues,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if oldValues != nil {
+		revision.OldValues = &CraftingMaterialSnapshot{}
+		if err := json.Unmarshal(oldValues, revision.OldValues); err != nil {
+			return nil, err
+		}
+	}
+
+	if newValues != nil {
+		revision.NewValues = &CraftingMaterialSnapshot{}
+		if err := json.Unmarshal(newValues, revision.NewValues); err != nil {
+			return nil, err
+		}
+	}
+
+	return &revision, nil
+}
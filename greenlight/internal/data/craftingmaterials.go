@@ -5,17 +5,25 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/lib/pq"
 	"greenlight.dimash.net/internal/validator"
+	"strconv"
 	"time"
 )
 
 type CraftingMaterials struct {
-	ID        int64     `json:"id"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Price     Price     `json:"price,string"`
-	CreatedAt time.Time `json:"-"`
-	Version   int32     `json:"version"`
+	ID         int64  `json:"id"`
+	Title      string `json:"title"`
+	Year       int32  `json:"year,omitempty"`
+	Price      Price  `json:"price"`
+	CategoryID *int64 `json:"category_id,omitempty"`
+	// CategoryPath holds the names of the categories from the root of the tree down to
+	// the crafting material's category. It is read only.
+	CategoryPath []string   `json:"category_path,omitempty"`
+	Tags         []string   `json:"tags"`
+	CreatedAt    time.Time  `json:"-"`
+	Version      int32      `json:"version"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
 }
 
 func ValidateCraftingMaterial(v *validator.Validator, materials *CraftingMaterials) {
@@ -23,37 +31,119 @@ func ValidateCraftingMaterial(v *validator.Validator, materials *CraftingMateria
 	v.Check(len(materials.Title) <= 500, "title", "must not be more than 500 bytes long")
 	v.Check(materials.Year >= 1888, "year", "must be greater than 1888")
 	v.Check(materials.Year <= int32(time.Now().Year()), "year", "must not be in the future")
-	v.Check(materials.Price > 0, "Price", "must be a positive integer")
+	ValidatePrice(v, materials.Price)
+	if materials.CategoryID != nil {
+		v.Check(*materials.CategoryID > 0, "category_id", "must be a positive integer")
+	}
+	ValidateTags(v, "tags", materials.Tags)
+}
+
+// Supported values for the search_mode query string parameter.
+const (
+	SearchModeFullText  = "fulltext"
+	SearchModeSubstring = "substring"
+)
+
+// CraftingMaterialSearch holds the search and filter parameters for listing crafting
+// materials. A zero value for any of the range bounds means that bound is not applied.
+type CraftingMaterialSearch struct {
+	Title      string
+	SearchMode string
+	// MinPrice and MaxPrice are in minor units of PriceCurrency, which must be given
+	// along with them. An empty PriceCurrency matches prices in every currency.
+	MinPrice      int64
+	MaxPrice      int64
+	PriceCurrency string
+	YearFrom      int
+	YearTo        int
+	// IncludeDeleted also returns soft deleted crafting materials.
+	IncludeDeleted bool
+	// CategoryID matches crafting materials in the category or any of its
+	// descendants.
+	CategoryID int64
+	// Tags matches crafting materials which carry every one of the tags.
+	Tags []string
+}
+
+func ValidateCraftingMaterialSearch(v *validator.Validator, search CraftingMaterialSearch) {
+	v.Check(validator.In(search.SearchMode, SearchModeFullText, SearchModeSubstring), "search_mode", "must be either fulltext or substring")
+
+	v.Check(search.PriceCurrency == "" || ValidCurrency(search.PriceCurrency), "price_currency", "must be a supported currency")
+	v.Check(search.MinPrice >= 0, "min_price", "must not be negative")
+	v.Check(search.MaxPrice >= 0, "max_price", "must not be negative")
+	if search.MinPrice > 0 && search.MaxPrice > 0 {
+		v.Check(search.MinPrice <= search.MaxPrice, "min_price", "must not be greater than max_price")
+	}
+
+	v.Check(search.YearFrom == 0 || search.YearFrom >= 1888, "year_from", "must be greater than 1888")
+	v.Check(search.YearTo == 0 || search.YearTo >= 1888, "year_to", "must be greater than 1888")
+	if search.YearFrom > 0 && search.YearTo > 0 {
+		v.Check(search.YearFrom <= search.YearTo, "year_from", "must not be greater than year_to")
+	}
+
+	v.Check(search.CategoryID >= 0, "category", "must be a positive integer")
+	ValidateTags(v, "tags", search.Tags)
+}
+
+// ValidateCraftingMaterialSort checks that a listing sorted by price is limited to a
+// single currency, as amounts in different currencies can't be compared.
+func ValidateCraftingMaterialSort(v *validator.Validator, sort string, search CraftingMaterialSearch) {
+	if sort == "price" || sort == "-price" {
+		v.Check(search.PriceCurrency != "", "price_currency", "must be provided to sort by price")
+	}
+}
+
+// craftingMaterialColumns are the category and tag columns selected alongside the
+// other fields of a crafting material.
+var craftingMaterialColumns = "category_id, tags, " + categoryPathSQL("craftingmaterials.category_id")
+
+// categoryFields returns the scan destinations for craftingMaterialColumns.
+func (material *CraftingMaterials) categoryFields() []interface{} {
+	return []interface{}{&material.CategoryID, pq.Array(&material.Tags), pq.Array(&material.CategoryPath)}
 }
 
 type CraftingMaterialModel struct {
 	DB *sql.DB
 }
 
-// Add a placeholder method for fetching a specific record from the movies table.
+// Get fetches a crafting material which hasn't been soft deleted.
 func (m CraftingMaterialModel) Get(id int64) (*CraftingMaterials, error) {
+	return m.get(id, false)
+}
+
+// GetIncludingDeleted fetches a crafting material whether or not it has been soft
+// deleted.
+func (m CraftingMaterialModel) GetIncludingDeleted(id int64) (*CraftingMaterials, error) {
+	return m.get(id, true)
+}
+
+func (m CraftingMaterialModel) get(id int64, includeDeleted bool) (*CraftingMaterials, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `
-	SELECT id, year, price, title, created_at, version 
+	query := fmt.Sprintf(`
+	SELECT id, year, price, price_currency, title, created_at, version, deleted_at, %s 
 	from craftingmaterials
-	where id = $1`
+	where id = $1 AND (deleted_at IS NULL OR $2)`, craftingMaterialColumns)
 
 	var material CraftingMaterials
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	dest := []interface{}{
 		&material.ID,
 		&material.Year,
-		&material.Price,
+		&material.Price.Amount,
+		&material.Price.Currency,
 		&material.Title,
 		&material.CreatedAt,
 		&material.Version,
-	)
+		&material.DeletedAt,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, id, includeDeleted).Scan(append(dest, material.categoryFields()...)...)
 
 	if err != nil {
 		switch {
@@ -67,88 +157,267 @@ func (m CraftingMaterialModel) Get(id int64) (*CraftingMaterials, error) {
 	return &material, nil
 }
 
-func (m CraftingMaterialModel) Update(material *CraftingMaterials) error {
-	query := `
-	UPDATE craftingmaterials
-	SET title = $1, year = $2, price = $3, version = version + 1
-	WHERE id = $4 AND version = $5
-	RETURNING version`
-
-	args := []interface{}{material.Title, material.Year, material.Price, material.ID, material.Version}
-
+// Update saves the changes to a crafting material, provided its version hasn't changed
+// since it was read, and records them in the history as the given action by the user.
+// oldValues holds the values the crafting material had at that version.
+func (m CraftingMaterialModel) Update(material *CraftingMaterials, oldValues *CraftingMaterialSnapshot, action string, userID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&material.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = updateCraftingMaterial(ctx, tx, material, oldValues, action, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func updateCraftingMaterial(ctx context.Context, tx *sql.Tx, material *CraftingMaterials, oldValues *CraftingMaterialSnapshot, action string, userID int64) error {
+	material.Tags = NormalizeTags(material.Tags)
+
+	args := []interface{}{
+		material.Title,
+		material.Year,
+		material.Price.Amount,
+		material.Price.Currency,
+		material.CategoryID,
+		pq.Array(material.Tags),
+		material.ID,
+		material.Version,
+	}
+
+	err := tx.QueryRowContext(ctx, updateCraftingMaterialQuery, args...).Scan(&material.Version, pq.Array(&material.CategoryPath))
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
+		case isForeignKeyViolation(err):
+			return ErrInvalidCategory
 		default:
 			return err
 		}
 	}
-	return nil
+
+	return insertRevision(ctx, tx, &CraftingMaterialRevision{
+		CraftingMaterialID: material.ID,
+		Version:            material.Version,
+		Action:             action,
+		UserID:             &userID,
+		OldValues:          oldValues,
+		NewValues:          material.Snapshot(),
+	})
 }
 
-func (m CraftingMaterialModel) Delete(id int64) error {
+// Delete soft deletes a crafting material by setting its deleted_at timestamp, and
+// records the deletion in the history. The record stays in the table until it is
+// restored or purged. Like Update(), it only succeeds if the crafting material is still
+// at the given version, and returns ErrEditConflict otherwise.
+func (m CraftingMaterialModel) Delete(id int64, version int32, userID int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	query := `
-	DELETE from craftingmaterials
-	where id = $1`
-
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// Call the RowsAffected() method on the sql.Result object to get the number of rows
-	// affected by the query.
-	rowsAffected, err := result.RowsAffected()
+	err = deleteCraftingMaterial(ctx, tx, id, version, userID)
 	if err != nil {
 		return err
 	}
 
-	// return an ErrRecordNotFound error.
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	return tx.Commit()
+}
+
+// deleteCraftingMaterial soft deletes a crafting material at the given version, or at
+// any version if it is zero. Crafting materials used by a recipe can't be deleted and
+// return ErrCraftingMaterialInUse.
+func deleteCraftingMaterial(ctx context.Context, tx *sql.Tx, id int64, version int32, userID int64) error {
+	// The values are unchanged by the delete, so the row returned holds the values
+	// being deleted along with the new version.
+	query := `
+	UPDATE craftingmaterials
+	SET deleted_at = NOW(), version = version + 1
+	where id = $1 AND deleted_at IS NULL AND (version = $2 OR $2 = 0)
+	RETURNING version, title, year, price, price_currency, category_id, tags`
+
+	var material CraftingMaterials
+
+	err := tx.QueryRowContext(ctx, query, id, version).Scan(
+		&material.Version,
+		&material.Title,
+		&material.Year,
+		&material.Price.Amount,
+		&material.Price.Currency,
+		&material.CategoryID,
+		pq.Array(&material.Tags),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows) && version != 0:
+			return ErrEditConflict
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
 	}
 
-	return nil
+	// This runs after the update has locked the row, so a recipe which is adding the
+	// crafting material either has already committed and is seen here, or is waiting
+	// for the lock and will find the crafting material deleted.
+	var inUse bool
+
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM recipe_materials WHERE crafting_material_id = $1)`, id).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+
+	if inUse {
+		return ErrCraftingMaterialInUse
+	}
+
+	return insertRevision(ctx, tx, &CraftingMaterialRevision{
+		CraftingMaterialID: id,
+		Version:            material.Version,
+		Action:             HistoryActionDelete,
+		UserID:             &userID,
+		OldValues:          material.Snapshot(),
+	})
 }
 
-func (m CraftingMaterialModel) Insert(material *CraftingMaterials) error {
-	query := `
-	INSERT INTO craftingmaterials (title, year, price) 
-	VALUES ($1, $2, $3) RETURNING id, created_at, version`
+var (
+	insertCraftingMaterialQuery = fmt.Sprintf(`
+	INSERT INTO craftingmaterials (title, year, price, price_currency, category_id, tags) 
+	VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at, version, %s`, categoryPathSQL("craftingmaterials.category_id"))
+
+	updateCraftingMaterialQuery = fmt.Sprintf(`
+	UPDATE craftingmaterials
+	SET title = $1, year = $2, price = $3, price_currency = $4, category_id = $5, tags = $6, version = version + 1
+	WHERE id = $7 AND version = $8 AND deleted_at IS NULL
+	RETURNING version, %s`, categoryPathSQL("craftingmaterials.category_id"))
+)
 
-	args := []interface{}{material.Title, material.Year, material.Price}
+func (material *CraftingMaterials) insertArgs() []interface{} {
+	material.Tags = NormalizeTags(material.Tags)
+	return []interface{}{material.Title, material.Year, material.Price.Amount, material.Price.Currency, material.CategoryID, pq.Array(material.Tags)}
+}
 
+// Insert creates a crafting material and records its creation by the user in the
+// history.
+func (m CraftingMaterialModel) Insert(material *CraftingMaterials, userID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	res := m.DB.QueryRowContext(ctx, query, args...).Scan(&material.ID, &material.CreatedAt, &material.Version)
-	return res
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertCraftingMaterial(ctx, tx, material, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertCraftingMaterial(ctx context.Context, tx *sql.Tx, material *CraftingMaterials, userID int64) error {
+	args := material.insertArgs()
+
+	err := tx.QueryRowContext(ctx, insertCraftingMaterialQuery, args...).Scan(&material.ID, &material.CreatedAt, &material.Version, pq.Array(&material.CategoryPath))
+	if err != nil {
+		switch {
+		case isForeignKeyViolation(err):
+			return ErrInvalidCategory
+		default:
+			return err
+		}
+	}
+
+	return insertRevision(ctx, tx, &CraftingMaterialRevision{
+		CraftingMaterialID: material.ID,
+		Version:            material.Version,
+		Action:             HistoryActionInsert,
+		UserID:             &userID,
+		NewValues:          material.Snapshot(),
+	})
+}
+
+// where returns the WHERE conditions for the search. The conditions use the
+// placeholders $1 to $9, bound to the values returned by args().
+func (search CraftingMaterialSearch) where() string {
+	// In full-text mode the title is matched against the GIN index on
+	// to_tsvector('simple', title), while substring mode keeps the old STRPOS lookup.
+	titleCondition := "(STRPOS(LOWER(title), LOWER($1)) > 0 OR $1 = '')"
+	if search.SearchMode == SearchModeFullText {
+		titleCondition = "(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')"
+	}
+
+	return titleCondition + `
+	and (price >= $2 OR $2 = 0)
+	and (price <= $3 OR $3 = 0)
+	and (year >= $4 OR $4 = 0)
+	and (year <= $5 OR $5 = 0)
+	and (deleted_at IS NULL OR $6)
+	and (price_currency = $7 OR $7 = '')
+	and (category_id IN ` + categorySubtreeSQL("$8") + ` OR $8 = 0)
+	and (tags @> $9 OR $9 = '{}')`
+}
+
+func (search CraftingMaterialSearch) args() []interface{} {
+	// A NULL array would never match, so send an empty one instead.
+	tags := search.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return []interface{}{search.Title, search.MinPrice, search.MaxPrice, search.YearFrom, search.YearTo, search.IncludeDeleted, search.PriceCurrency, search.CategoryID, pq.Array(tags)}
+}
+
+func craftingMaterialsOrderBy(filters Filters) string {
+	if filters.sortColumn() == "rank" {
+		// Most relevant results first.
+		return "ts_rank(to_tsvector('simple', title), plainto_tsquery('simple', $1)) DESC, id ASC"
+	}
+	return filters.orderBy()
 }
 
-func (m CraftingMaterialModel) GetAll(title string, filters Filters) ([]*CraftingMaterials, Metadata, error) {
+func (m CraftingMaterialModel) GetAll(search CraftingMaterialSearch, filters Filters) ([]*CraftingMaterials, Metadata, error) {
+	keysetCondition, keysetArgs := filters.keysetCondition(12)
+
+	// The window count has to read every matching row, which is what cursor pagination
+	// avoids, and its metadata has no total anyway, so it's only counted for pages.
+	totalColumn := "count(*) OVER()"
+	if filters.Keyset {
+		totalColumn = "0"
+	}
+
 	query := fmt.Sprintf(`
-	SELECT count(*) OVER(), id, created_at, title, year, price, version 
+	SELECT %s, id, created_at, title, year, price, price_currency, version, deleted_at, %s 
 	from craftingmaterials
-	where (STRPOS(LOWER(title), LOWER($1)) > 0 OR $1 = '')
-	order by %s %s, id ASC
-	LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	where %s
+	and %s
+	order by %s
+	LIMIT $10 OFFSET $11`, totalColumn, craftingMaterialColumns, search.where(), keysetCondition, craftingMaterialsOrderBy(filters))
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{title, filters.limit(), filters.offset()}
+	args := append(search.args(), filters.limit(), filters.offset())
+	args = append(args, keysetArgs...)
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -168,15 +437,18 @@ func (m CraftingMaterialModel) GetAll(title string, filters Filters) ([]*Craftin
 		// Initialize an empty Movie struct to hold the data for an individual movie.
 		var material CraftingMaterials
 		// Scan the values from the row into the Crafting Material struct.
-		err := rows.Scan(
+		dest := []interface{}{
 			&totalRecords,
 			&material.ID,
 			&material.CreatedAt,
 			&material.Title,
 			&material.Year,
-			&material.Price,
+			&material.Price.Amount,
+			&material.Price.Currency,
 			&material.Version,
-		)
+			&material.DeletedAt,
+		}
+		err := rows.Scan(append(dest, material.categoryFields()...)...)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -188,7 +460,278 @@ func (m CraftingMaterialModel) GetAll(title string, filters Filters) ([]*Craftin
 		return nil, Metadata{}, err
 	}
 
+	if filters.Keyset {
+		// We asked for one row more than the page size, so if it came back there is
+		// another page and the last row of this page becomes the next cursor.
+		hasNext := len(craftingMaterialsList) > filters.PageSize
+		if !hasNext {
+			return craftingMaterialsList, calculateKeysetMetadata(false, filters.PageSize, filters.Sort, "", 0), nil
+		}
+
+		craftingMaterialsList = craftingMaterialsList[:filters.PageSize]
+		last := craftingMaterialsList[len(craftingMaterialsList)-1]
+		metadata := calculateKeysetMetadata(true, filters.PageSize, filters.Sort, last.sortValue(filters.sortColumn()), last.ID)
+
+		return craftingMaterialsList, metadata, nil
+	}
+
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 
 	return craftingMaterialsList, metadata, nil
 }
+
+// sortValue returns the value of the given sort column for the crafting material, in
+// the form stored inside a pagination cursor.
+func (material *CraftingMaterials) sortValue(column string) string {
+	switch column {
+	case "title":
+		return material.Title
+	case "year":
+		return strconv.FormatInt(int64(material.Year), 10)
+	case "price":
+		return strconv.FormatInt(material.Price.Amount, 10)
+	default:
+		return strconv.FormatInt(material.ID, 10)
+	}
+}
+
+// InsertMany inserts all the given crafting materials in a single transaction, so
+// either every record is created or none of them are.
+func (m CraftingMaterialModel) InsertMany(materials []*CraftingMaterials, userID int64) error {
+	// Imports can hold tens of thousands of records, so allow as long as the server's
+	// write timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, material := range materials {
+		err := insertCraftingMaterial(ctx, tx, material, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateMany updates all the given crafting materials in a single transaction, using
+// the same version check as Update(). oldValues holds the values of each crafting
+// material at the version it was read. If any record fails the check, the transaction
+// is rolled back and the returned map holds an ErrEditConflict keyed by the index of
+// each failing record.
+func (m CraftingMaterialModel) UpdateMany(materials []*CraftingMaterials, oldValues []*CraftingMaterialSnapshot, userID int64) (map[int]error, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	itemErrors := make(map[int]error)
+
+	for i, material := range materials {
+		err := updateCraftingMaterial(ctx, tx, material, oldValues[i], HistoryActionUpdate, userID)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrEditConflict):
+				itemErrors[i] = ErrEditConflict
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	if len(itemErrors) > 0 {
+		return itemErrors, nil
+	}
+
+	return nil, tx.Commit()
+}
+
+// DeleteMany soft deletes the crafting materials with the given ids in a single
+// transaction. If any id doesn't exist or is used by a recipe, nothing is deleted and
+// the returned map holds an ErrRecordNotFound or ErrCraftingMaterialInUse keyed by the
+// index of each failing id.
+func (m CraftingMaterialModel) DeleteMany(ids []int64, userID int64) (map[int]error, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	itemErrors := make(map[int]error)
+
+	for i, id := range ids {
+		err := deleteCraftingMaterial(ctx, tx, id, 0, userID)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrRecordNotFound), errors.Is(err, ErrCraftingMaterialInUse):
+				itemErrors[i] = err
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	if len(itemErrors) > 0 {
+		return itemErrors, nil
+	}
+
+	return nil, tx.Commit()
+}
+
+// Stream runs the same query as GetAll() without any pagination and calls fn for each
+// crafting material as it is read from the resultset, so the caller never has to hold
+// the whole table in memory. Iteration stops at the first error returned by fn.
+func (m CraftingMaterialModel) Stream(search CraftingMaterialSearch, filters Filters, fn func(*CraftingMaterials) error) error {
+	query := fmt.Sprintf(`
+	SELECT id, created_at, title, year, price, price_currency, version, deleted_at, %s 
+	from craftingmaterials
+	where %s
+	order by %s`, craftingMaterialColumns, search.where(), craftingMaterialsOrderBy(filters))
+
+	// Exports can be large, so allow as long as the server's write timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, search.args()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var material CraftingMaterials
+
+		dest := []interface{}{
+			&material.ID,
+			&material.CreatedAt,
+			&material.Title,
+			&material.Year,
+			&material.Price.Amount,
+			&material.Price.Currency,
+			&material.Version,
+			&material.DeletedAt,
+		}
+		err := rows.Scan(append(dest, material.categoryFields()...)...)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&material)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Restore undoes a soft delete and records it in the history. It returns
+// ErrRecordNotFound if there is no deleted crafting material with the given id.
+func (m CraftingMaterialModel) Restore(id int64, userID int64) (*CraftingMaterials, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+	UPDATE craftingmaterials
+	SET deleted_at = NULL, version = version + 1
+	WHERE id = $1 AND deleted_at IS NOT NULL
+	RETURNING id, year, price, price_currency, title, created_at, version, %s`, craftingMaterialColumns)
+
+	var material CraftingMaterials
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	dest := []interface{}{
+		&material.ID,
+		&material.Year,
+		&material.Price.Amount,
+		&material.Price.Currency,
+		&material.Title,
+		&material.CreatedAt,
+		&material.Version,
+	}
+
+	err = tx.QueryRowContext(ctx, query, id).Scan(append(dest, material.categoryFields()...)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = insertRevision(ctx, tx, &CraftingMaterialRevision{
+		CraftingMaterialID: material.ID,
+		Version:            material.Version,
+		Action:             HistoryActionRestore,
+		UserID:             &userID,
+		NewValues:          material.Snapshot(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &material, nil
+}
+
+// PurgeDeleted permanently removes crafting materials which were soft deleted more
+// than retention ago, returning the number of records removed. Their attachments are
+// removed along with them by the foreign key cascade, so the storage keys of the
+// attachment files are returned for the caller to delete. Crafting materials still used
+// by a recipe are kept. Their history isn't removed, so it remains as an audit trail.
+func (m CraftingMaterialModel) PurgeDeleted(retention time.Duration) (int64, []string, error) {
+	// The SELECT sees the attachments as they were before the statement ran, so it can
+	// still read the rows the cascade removes.
+	query := `
+	WITH purged AS (
+		DELETE from craftingmaterials
+		WHERE deleted_at IS NOT NULL AND deleted_at < $1
+		AND NOT EXISTS (SELECT 1 FROM recipe_materials rm WHERE rm.crafting_material_id = craftingmaterials.id)
+		RETURNING id
+	),
+	keys AS (
+		SELECT unnest(ARRAY[a.storage_key, a.thumbnail_key]) AS key
+		FROM craftingmaterial_attachments a
+		INNER JOIN purged p ON p.id = a.crafting_material_id
+	)
+	SELECT (SELECT count(*) FROM purged), ARRAY(SELECT key FROM keys WHERE key IS NOT NULL)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var purged int64
+	var keys []string
+
+	err := m.DB.QueryRowContext(ctx, query, time.Now().Add(-retention)).Scan(&purged, pq.Array(&keys))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return purged, keys, nil
+}
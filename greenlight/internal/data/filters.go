@@ -1,16 +1,56 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"greenlight.dimash.net/internal/validator"
 	"math"
 	"strings"
 )
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 type Filters struct {
 	Page         int
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// Keyset switches pagination from LIMIT/OFFSET to cursor based pagination. Cursor
+	// holds the opaque value returned as next_cursor by the previous page, or an empty
+	// string for the first page.
+	Keyset bool
+	Cursor string
+}
+
+// cursor is the decoded form of the opaque cursor string. It records the sort it was
+// created for along with the sort key and id of the last record on the previous page.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+func encodeCursor(c cursor) string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	err = json.Unmarshal(js, &c)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	return c, nil
 }
 
 // Check that the client-provided Sort field matches one of the entries in our safelist
@@ -35,13 +75,50 @@ func (f Filters) sortDirection() string {
 }
 
 func (f Filters) limit() int {
+	// In keyset mode we fetch one extra row so that we know whether there is a next page.
+	if f.Keyset {
+		return f.PageSize + 1
+	}
 	return f.PageSize
 }
 
 func (f Filters) offset() int {
+	if f.Keyset {
+		return 0
+	}
 	return (f.Page - 1) * f.PageSize
 }
 
+// keysetCondition returns the SQL condition which selects the records after the cursor,
+// along with its arguments. The placeholders are numbered starting from argNum. For the
+// first page (an empty cursor) it returns a condition which is always true.
+func (f Filters) keysetCondition(argNum int) (string, []interface{}) {
+	if !f.Keyset || f.Cursor == "" {
+		return "true", nil
+	}
+
+	// The cursor has already been checked by ValidateFilters().
+	c, _ := decodeCursor(f.Cursor)
+
+	operator := ">"
+	if f.sortDirection() == "DESC" {
+		operator = "<"
+	}
+
+	condition := fmt.Sprintf("(%s, id) %s ($%d, $%d)", f.sortColumn(), operator, argNum, argNum+1)
+	return condition, []interface{}{c.Value, c.ID}
+}
+
+// orderBy returns the ORDER BY expression for the filters. In keyset mode the id
+// tie-breaker must follow the same direction as the sort column so that the row
+// comparison in keysetCondition() matches the ordering.
+func (f Filters) orderBy() string {
+	if f.Keyset {
+		return fmt.Sprintf("%s %s, id %s", f.sortColumn(), f.sortDirection(), f.sortDirection())
+	}
+	return fmt.Sprintf("%s %s, id ASC", f.sortColumn(), f.sortDirection())
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
 	v.Check(f.Page > 0, "page", "must be greater than zero")
@@ -51,14 +128,21 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	if f.Keyset && f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		v.Check(err == nil, "cursor", "must be a valid cursor")
+		v.Check(err != nil || c.Sort == f.Sort, "cursor", "was created for a different sort value")
+	}
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -75,3 +159,15 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// calculateKeysetMetadata builds the metadata for a page fetched in keyset mode. The
+// next cursor is only set when more records are available after lastValue/lastID.
+func calculateKeysetMetadata(hasNext bool, pageSize int, sort, lastValue string, lastID int64) Metadata {
+	metadata := Metadata{PageSize: pageSize}
+
+	if hasNext {
+		metadata.NextCursor = encodeCursor(cursor{Sort: sort, Value: lastValue, ID: lastID})
+	}
+
+	return metadata
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrInsufficientQuantity = errors.New("insufficient quantity")
+
+// InventoryItem is the quantity of a crafting material owned by a user.
+type InventoryItem struct {
+	CraftingMaterialID int64     `json:"crafting_material_id"`
+	Title              string    `json:"title"`
+	Quantity           int64     `json:"quantity"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+type InventoryModel struct {
+	DB *sql.DB
+}
+
+// GetAllForUser returns every crafting material the user holds a non-zero quantity of,
+// ordered by crafting material id. Like the rest of the inventory, it leaves out soft
+// deleted crafting materials, which come back if they are restored.
+func (m InventoryModel) GetAllForUser(userID int64) ([]*InventoryItem, error) {
+	query := `
+	SELECT ui.crafting_material_id, cm.title, ui.quantity, ui.updated_at
+	FROM user_inventory ui
+	INNER JOIN craftingmaterials cm ON cm.id = ui.crafting_material_id
+	WHERE ui.user_id = $1 AND ui.quantity > 0 AND cm.deleted_at IS NULL
+	ORDER BY ui.crafting_material_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []*InventoryItem{}
+
+	for rows.Next() {
+		var item InventoryItem
+
+		err := rows.Scan(&item.CraftingMaterialID, &item.Title, &item.Quantity, &item.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// Get returns the user's quantity of a crafting material. A crafting material the user
+// has never held is returned with a quantity of zero.
+func (m InventoryModel) Get(userID, materialID int64) (*InventoryItem, error) {
+	query := `
+	SELECT cm.id, cm.title, COALESCE(ui.quantity, 0), COALESCE(ui.updated_at, cm.created_at)
+	FROM craftingmaterials cm
+	LEFT JOIN user_inventory ui ON ui.crafting_material_id = cm.id AND ui.user_id = $1
+	WHERE cm.id = $2 AND cm.deleted_at IS NULL`
+
+	var item InventoryItem
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, materialID).Scan(
+		&item.CraftingMaterialID,
+		&item.Title,
+		&item.Quantity,
+		&item.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &item, nil
+}
+
+// Set replaces the user's quantity of a crafting material.
+func (m InventoryModel) Set(userID, materialID, quantity int64) (*InventoryItem, error) {
+	query := `
+	INSERT INTO user_inventory (user_id, crafting_material_id, quantity)
+	SELECT $1, id, $3 FROM craftingmaterials WHERE id = $2 AND deleted_at IS NULL
+	ON CONFLICT (user_id, crafting_material_id)
+	DO UPDATE SET quantity = EXCLUDED.quantity, updated_at = NOW()
+	RETURNING crafting_material_id, quantity, updated_at`
+
+	return m.queryItem(query, userID, materialID, quantity)
+}
+
+// Adjust atomically adds delta, which may be negative, to the user's quantity of a
+// crafting material. If the result would be negative nothing is changed and
+// ErrInsufficientQuantity is returned, and if it wouldn't fit in a bigint
+// ErrQuantityOutOfRange is returned.
+func (m InventoryModel) Adjust(userID, materialID, delta int64) (*InventoryItem, error) {
+	// In both cases the arithmetic happens inside a single statement, so concurrent
+	// adjustments can't overwrite each other.
+	if delta >= 0 {
+		query := `
+		INSERT INTO user_inventory (user_id, crafting_material_id, quantity)
+		SELECT $1, id, $3 FROM craftingmaterials WHERE id = $2 AND deleted_at IS NULL
+		ON CONFLICT (user_id, crafting_material_id)
+		DO UPDATE SET quantity = user_inventory.quantity + EXCLUDED.quantity, updated_at = NOW()
+		RETURNING crafting_material_id, quantity, updated_at`
+
+		return m.queryItem(query, userID, materialID, delta)
+	}
+
+	// A decrement can't go through the upsert above, because the CHECK constraint is
+	// applied to the negative row proposed for insertion before the conflict is
+	// resolved. A user who holds none of the material has nothing to take away.
+	query := `
+	UPDATE user_inventory ui
+	SET quantity = ui.quantity + $3, updated_at = NOW()
+	FROM craftingmaterials cm
+	WHERE ui.user_id = $1 AND ui.crafting_material_id = $2 AND ui.quantity + $3 >= 0
+	AND cm.id = ui.crafting_material_id AND cm.deleted_at IS NULL
+	RETURNING ui.crafting_material_id, ui.quantity, ui.updated_at`
+
+	item, err := m.queryItem(query, userID, materialID, delta)
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil, ErrInsufficientQuantity
+	}
+
+	return item, err
+}
+
+func (m InventoryModel) queryItem(query string, userID, materialID, quantity int64) (*InventoryItem, error) {
+	var item InventoryItem
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, materialID, quantity).Scan(
+		&item.CraftingMaterialID,
+		&item.Quantity,
+		&item.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		// No row is inserted when the crafting material doesn't exist.
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		case strings.Contains(err.Error(), `"user_inventory_quantity_check"`):
+			return nil, ErrInsufficientQuantity
+		case isOutOfRange(err):
+			return nil, ErrQuantityOutOfRange
+		default:
+			return nil, err
+		}
+	}
+
+	return &item, nil
+}
+
+// Delete removes a crafting material from the user's inventory.
+func (m InventoryModel) Delete(userID, materialID int64) error {
+	query := `
+	DELETE FROM user_inventory ui
+	USING craftingmaterials cm
+	WHERE ui.user_id = $1 AND ui.crafting_material_id = $2 AND ui.quantity > 0
+	AND cm.id = ui.crafting_material_id AND cm.deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, materialID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Quantities returns the user's inventory in the form used by RecipeModel.Craftable().
+func (m InventoryModel) Quantities(userID int64) ([]MaterialQuantity, error) {
+	items, err := m.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	quantities := make([]MaterialQuantity, len(items))
+	for i, item := range items {
+		quantities[i] = MaterialQuantity{CraftingMaterialID: item.CraftingMaterialID, Quantity: item.Quantity}
+	}
+
+	return quantities, nil
+}
@@ -0,0 +1,210 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Failed logins are counted separately for each account, by email address, and for
+// each client IP address.
+const (
+	ThrottleScopeAccount = "account"
+	ThrottleScopeIP      = "ip"
+)
+
+// LoginThrottle counts the recent failed logins for an account or IP address. Once
+// Failures reaches the lockout threshold, LockedUntil is set and no logins are allowed
+// until then.
+type LoginThrottle struct {
+	Scope        string
+	Key          string
+	Failures     int
+	LastFailedAt time.Time
+	LockedUntil  *time.Time
+}
+
+// Locked reports whether logins are refused at the given time.
+func (t *LoginThrottle) Locked(now time.Time) bool {
+	return t.LockedUntil != nil && now.Before(*t.LockedUntil)
+}
+
+type LoginThrottleModel struct {
+	DB *sql.DB
+}
+
+func (m LoginThrottleModel) Get(scope, key string) (*LoginThrottle, error) {
+	query := `
+	SELECT scope, key, failures, last_failed_at, locked_until
+	FROM login_throttles
+	WHERE scope = $1 AND key = $2`
+
+	var t LoginThrottle
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, scope, key).Scan(
+		&t.Scope,
+		&t.Key,
+		&t.Failures,
+		&t.LastFailedAt,
+		&t.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// backoff returns how long to wait after the given number of consecutive failures
+// before another login is allowed. The wait doubles with every failure, and reaches the
+// lockout duration at the threshold.
+func backoff(failures, threshold int, lockout time.Duration) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+
+	shift := threshold - failures
+	if shift < 0 {
+		shift = 0
+	}
+	if shift >= 63 {
+		return 0
+	}
+
+	return lockout >> shift
+}
+
+// Reserve counts a login attempt as a failure before its credentials are checked, so
+// that concurrent attempts can't all get in before the first of them is counted. The
+// count starts again from one when the previous failure was longer ago than the lockout
+// duration, and when it reaches threshold the account or IP address is locked for that
+// duration. If the attempt has to wait for the backoff or lockout of earlier failures,
+// nothing is counted and the time left to wait is returned instead. Attempts which turn
+// out to succeed are handed back with Release or Reset.
+func (m LoginThrottleModel) Reserve(scope, key string, threshold int, lockout time.Duration) (*LoginThrottle, time.Duration, error) {
+	// The new count is needed in two places, and an UPDATE can't refer to the value it
+	// assigns, so the expression is repeated. The WHERE clause is the same check as
+	// backoff(), so that it's made on the locked row.
+	query := `
+	INSERT INTO login_throttles (scope, key, failures, last_failed_at, locked_until)
+	VALUES ($1, $2, 1, NOW(), CASE WHEN 1 >= $3 THEN NOW() + $4 * interval '1 second' END)
+	ON CONFLICT (scope, key) DO UPDATE SET
+		failures = CASE
+			WHEN login_throttles.last_failed_at < NOW() - $4 * interval '1 second' THEN 1
+			ELSE login_throttles.failures + 1
+		END,
+		last_failed_at = NOW(),
+		locked_until = CASE
+			WHEN login_throttles.last_failed_at < NOW() - $4 * interval '1 second' THEN
+				CASE WHEN 1 >= $3 THEN NOW() + $4 * interval '1 second' END
+			WHEN login_throttles.failures + 1 >= $3 THEN NOW() + $4 * interval '1 second'
+		END
+	WHERE login_throttles.last_failed_at < NOW() - $4 * interval '1 second'
+		OR login_throttles.failures = 0
+		OR ((login_throttles.locked_until IS NULL OR login_throttles.locked_until <= NOW())
+			AND NOW() >= login_throttles.last_failed_at
+				+ $4 * interval '1 second' / power(2, greatest($3 - login_throttles.failures, 0)))
+	RETURNING scope, key, failures, last_failed_at, locked_until`
+
+	var t LoginThrottle
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, scope, key, threshold, lockout.Seconds()).Scan(
+		&t.Scope,
+		&t.Key,
+		&t.Failures,
+		&t.LastFailedAt,
+		&t.LockedUntil,
+	)
+	if err == nil {
+		return &t, 0, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, err
+	}
+
+	// The attempt was refused, so work out how long is left to wait. If the row has
+	// changed or gone in the meantime, the client is asked to try again shortly.
+	wait := time.Second
+
+	throttle, err := m.Get(scope, key)
+	if err != nil && !errors.Is(err, ErrRecordNotFound) {
+		return nil, 0, err
+	}
+
+	if throttle != nil {
+		now := time.Now()
+
+		until := throttle.LastFailedAt.Add(backoff(throttle.Failures, threshold, lockout))
+		if throttle.Locked(now) {
+			until = *throttle.LockedUntil
+		}
+
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+
+	return nil, wait, nil
+}
+
+// Release hands back an attempt counted by Reserve which turned out not to be a
+// failure, lifting the lockout if the attempt had caused it. The time of the last
+// failure is left as it is, so the next attempt still waits out the backoff for the
+// failures before it.
+func (m LoginThrottleModel) Release(scope, key string, threshold int) error {
+	query := `
+	UPDATE login_throttles
+	SET failures = failures - 1,
+		locked_until = CASE WHEN failures - 1 >= $3 THEN locked_until END
+	WHERE scope = $1 AND key = $2 AND failures > 0`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, key, threshold)
+	return err
+}
+
+// Reset clears the failed logins for an account or IP address, lifting any lockout.
+func (m LoginThrottleModel) Reset(scope, key string) error {
+	query := `
+	DELETE FROM login_throttles
+	WHERE scope = $1 AND key = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, key)
+	return err
+}
+
+// DeleteExpired deletes the counts whose last failure was longer ago than the lockout
+// duration, which Reserve would start again from one anyway.
+func (m LoginThrottleModel) DeleteExpired(lockout time.Duration) (int64, error) {
+	query := `
+	DELETE FROM login_throttles
+	WHERE last_failed_at < NOW() - $1 * interval '1 second'
+		AND (locked_until IS NULL OR locked_until <= NOW())`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, lockout.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -13,18 +13,36 @@ var (
 )
 
 type Models struct {
-	CraftingMaterials CraftingMaterialModel
-	Users             UserModel
-	Tokens            TokenModel
-	Permissions       PermissionModel
+	CraftingMaterials       CraftingMaterialModel
+	CraftingMaterialHistory CraftingMaterialHistoryModel
+	Categories              CategoryModel
+	Recipes                 RecipeModel
+	Inventory               InventoryModel
+	Attachments             AttachmentModel
+	Movies                  MovieModel
+	Users                   UserModel
+	Tokens                  TokenModel
+	APIKeys                 APIKeyModel
+	TOTP                    TOTPModel
+	LoginThrottles          LoginThrottleModel
+	Permissions             PermissionModel
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
 func NewModels(db *sql.DB) Models {
 	return Models{
-		CraftingMaterials: CraftingMaterialModel{DB: db},
-		Users:             UserModel{DB: db},
-		Tokens:            TokenModel{DB: db},
-		Permissions:       PermissionModel{DB: db},
+		CraftingMaterials:       CraftingMaterialModel{DB: db},
+		CraftingMaterialHistory: CraftingMaterialHistoryModel{DB: db},
+		Categories:              CategoryModel{DB: db},
+		Recipes:                 RecipeModel{DB: db},
+		Inventory:               InventoryModel{DB: db},
+		Attachments:             AttachmentModel{DB: db},
+		Movies:                  MovieModel{DB: db},
+		Users:                   UserModel{DB: db},
+		Tokens:                  TokenModel{DB: db},
+		APIKeys:                 APIKeyModel{DB: db},
+		TOTP:                    TOTPModel{DB: db},
+		LoginThrottles:          LoginThrottleModel{DB: db},
+		Permissions:             PermissionModel{DB: db},
 	}
 }
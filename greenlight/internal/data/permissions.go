@@ -59,6 +59,47 @@ func (m PermissionModel) GetAllPermissionsForUser(userID int64) (Permissions, er
 	return permissions, nil
 }
 
+// GetAllPermissionsForAPIKey returns the permissions an API key grants. These are the
+// permissions it was created with which its owner still holds, so that taking a
+// permission away from a user also takes it away from their keys.
+func (m PermissionModel) GetAllPermissionsForAPIKey(keyID int64) (Permissions, error) {
+	query := `
+	SELECT permissions.code
+	FROM permissions
+	INNER JOIN api_keys_permissions ON api_keys_permissions.permission_id = permissions.id
+	INNER JOIN api_keys ON api_keys_permissions.api_key_id = api_keys.id
+	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = api_keys.user_id
+	WHERE api_keys.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
 func (m PermissionModel) AddPermissionForUser(userID int64, codes ...string) error {
 	query := `
 	INSERT INTO users_permissions
@@ -1,46 +1,256 @@
 package data
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"greenlight.dimash.net/internal/validator"
+	"math"
 	"strconv"
 	"strings"
 )
 
-var ErrInvalidPriceFormat = errors.New("invalid price format")
+var (
+	ErrInvalidPriceFormat = errors.New("invalid price format")
+	ErrUnknownCurrency    = errors.New("unknown currency")
+	ErrPriceOutOfRange    = errors.New("price is out of range")
+)
 
-type Price int32
+// DefaultCurrency is used for prices given in the legacy "N $" format, and is the
+// currency of every price created before multi-currency support.
+const DefaultCurrency = "USD"
 
-func (p Price) MarshalJSON() ([]byte, error) {
+// currencyMinorUnits maps the ISO 4217 codes we accept to the number of digits after
+// the decimal point in their minor unit (cents for USD, none for JPY and so on).
+var currencyMinorUnits = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KZT": 2,
+	"RUB": 2,
+	"TRY": 2,
+	"USD": 2,
+}
 
-	jsonValue := fmt.Sprintf("%d $", p)
-	quotedValue := strconv.Quote(jsonValue)
+// ValidCurrency reports whether the given ISO 4217 code is supported.
+func ValidCurrency(code string) bool {
+	_, ok := currencyMinorUnits[code]
+	return ok
+}
 
-	return []byte(quotedValue), nil
+// Price is an amount of money in a given currency. Amount is stored in minor units
+// (for example cents), so 12.50 EUR is Price{Amount: 1250, Currency: "EUR"}.
+type Price struct {
+	Amount   int64
+	Currency string
 }
 
-func (p *Price) UnmarshalJSON(jsonValue []byte) error {
+// String formats the price as "<amount> <currency>", for example "12.50 EUR".
+func (p Price) String() string {
+	return FormatAmount(p.Amount, p.Currency) + " " + p.Currency
+}
 
-	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
+// FormatAmount formats an amount in minor units as a decimal string in the major unit
+// of the currency, for example 1250 EUR as "12.50".
+func FormatAmount(amount int64, currency string) string {
+	digits := currencyMinorUnits[currency]
+	if digits == 0 {
+		return strconv.FormatInt(amount, 10)
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	scale := pow10(digits)
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, digits, amount%scale)
+}
+
+// ParseAmount parses a decimal string in the major unit of the currency, for example
+// "12.5" EUR, into minor units. It rejects values with more decimal places than the
+// currency allows, and ErrPriceOutOfRange is returned if the amount in minor units
+// doesn't fit in an int64.
+func ParseAmount(s, currency string) (int64, error) {
+	digits, ok := currencyMinorUnits[currency]
+	if !ok {
+		return 0, ErrUnknownCurrency
+	}
+
+	whole, fraction, hasFraction := strings.Cut(s, ".")
+	if whole == "" || (hasFraction && (fraction == "" || len(fraction) > digits)) {
+		return 0, ErrInvalidPriceFormat
+	}
+
+	major, err := strconv.ParseInt(whole, 10, 64)
 	if err != nil {
-		return ErrInvalidPriceFormat
+		return 0, ErrInvalidPriceFormat
+	}
+
+	minor := int64(0)
+	if hasFraction {
+		// Pad the fraction to the full number of minor digits, so "12.5" is 1250.
+		minor, err = strconv.ParseInt(fraction+strings.Repeat("0", digits-len(fraction)), 10, 64)
+		if err != nil || strings.HasPrefix(fraction, "-") || strings.HasPrefix(fraction, "+") {
+			return 0, ErrInvalidPriceFormat
+		}
+	}
+
+	if strings.HasPrefix(whole, "-") {
+		minor = -minor
+	}
+
+	scale := pow10(digits)
+	if major > math.MaxInt64/scale || major < math.MinInt64/scale {
+		return 0, ErrPriceOutOfRange
+	}
+
+	amount := major * scale
+	if (minor > 0 && amount > math.MaxInt64-minor) || (minor < 0 && amount < math.MinInt64-minor) {
+		return 0, ErrPriceOutOfRange
+	}
+
+	return amount + minor, nil
+}
+
+// Convert returns the price in another currency, given the exchange rate from the
+// price's currency to that currency. The result is rounded to the nearest minor unit,
+// and ErrPriceOutOfRange is returned if it doesn't fit in an int64.
+func (p Price) Convert(currency string, rate float64) (Price, error) {
+	if currency == p.Currency {
+		return p, nil
+	}
+
+	major := float64(p.Amount) / float64(pow10(currencyMinorUnits[p.Currency]))
+	amount := math.Round(major * rate * float64(pow10(currencyMinorUnits[currency])))
+
+	// float64(math.MaxInt64) rounds up to 2^63, which is already out of range.
+	if amount >= math.MaxInt64 || amount < math.MinInt64 || math.IsNaN(amount) {
+		return Price{}, ErrPriceOutOfRange
+	}
+
+	return Price{Amount: int64(amount), Currency: currency}, nil
+}
+
+// Multiply returns the price of n of something which costs p. ErrPriceOutOfRange is
+// returned if the amount doesn't fit in an int64.
+func (p Price) Multiply(n int64) (Price, error) {
+	if n == 0 {
+		return Price{Currency: p.Currency}, nil
+	}
+
+	product := p.Amount * n
+	if product/n != p.Amount || (n == -1 && p.Amount == math.MinInt64) {
+		return Price{}, ErrPriceOutOfRange
 	}
 
-	parts := strings.Split(unquotedJSONValue, " ")
+	return Price{Amount: product, Currency: p.Currency}, nil
+}
+
+// Add returns the sum of two prices in the same currency. ErrPriceOutOfRange is
+// returned if the amount doesn't fit in an int64.
+func (p Price) Add(other Price) (Price, error) {
+	if (other.Amount > 0 && p.Amount > math.MaxInt64-other.Amount) || (other.Amount < 0 && p.Amount < math.MinInt64-other.Amount) {
+		return Price{}, ErrPriceOutOfRange
+	}
+
+	return Price{Amount: p.Amount + other.Amount, Currency: p.Currency}, nil
+}
+
+func pow10(n int) int64 {
+	result := int64(1)
+	for i := 0; i < n; i++ {
+		result *= 10
+	}
+	return result
+}
+
+// ParsePrice parses a price in the "<amount> <currency>" format, for example
+// "12.50 EUR". The legacy "<amount> $" format is accepted as US dollars.
+func ParsePrice(s string) (Price, error) {
+	parts := strings.Split(s, " ")
 	// Sanity check the parts of the string to make sure it was in the expected format.
-	// If it isn't, we return the ErrInvalidRuntimeFormat error again.
-	if len(parts) != 2 || parts[1] != "$" {
-		return ErrInvalidPriceFormat
+	if len(parts) != 2 {
+		return Price{}, ErrInvalidPriceFormat
+	}
+
+	currency := strings.ToUpper(parts[1])
+	if currency == "$" {
+		currency = DefaultCurrency
+	}
+
+	amount, err := ParseAmount(parts[0], currency)
+	if err != nil {
+		return Price{}, err
+	}
+
+	return Price{Amount: amount, Currency: currency}, nil
+}
+
+func ValidatePrice(v *validator.Validator, price Price) {
+	v.Check(price.Amount > 0, "price", "must be a positive amount")
+	v.Check(ValidCurrency(price.Currency), "price", "must use a supported currency")
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(p.String())), nil
+}
+
+// UnmarshalJSON accepts either a string such as "12.50 EUR" (or the legacy "120 $"), or
+// an object such as {"amount": "12.50", "currency": "EUR"}, where the amount may also be
+// given as a JSON number.
+func (p *Price) UnmarshalJSON(jsonValue []byte) error {
+	jsonValue = bytes.TrimSpace(jsonValue)
+
+	if len(jsonValue) > 0 && jsonValue[0] == '{' {
+		var input struct {
+			Amount   json.RawMessage `json:"amount"`
+			Currency string          `json:"currency"`
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(jsonValue))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&input)
+		if err != nil || input.Amount == nil {
+			return ErrInvalidPriceFormat
+		}
+
+		// The amount is kept as its raw text so that it is never rounded through a
+		// float64.
+		amount := string(input.Amount)
+		if unquoted, err := strconv.Unquote(amount); err == nil {
+			amount = unquoted
+		}
+
+		currency := strings.ToUpper(input.Currency)
+
+		val, err := ParseAmount(amount, currency)
+		if err != nil {
+			return err
+		}
+
+		*p = Price{Amount: val, Currency: currency}
+		return nil
 	}
-	// Otherwise, parse the string containing the number into an int32. Again, if this
-	// fails return the ErrInvalidRuntimeFormat error.
-	val, err := strconv.ParseInt(parts[0], 10, 32)
+
+	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
 	if err != nil {
 		return ErrInvalidPriceFormat
 	}
-	// Convert the int32 to a Runtime type and assign this to the receiver. Note that we
-	// use the * operator to deference the receiver (which is a pointer to a Runtime
-	// type) in order to set the underlying value of the pointer.
-	*p = Price(val)
+
+	price, err := ParsePrice(unquotedJSONValue)
+	if err != nil {
+		return err
+	}
+
+	*p = price
 	return nil
 }
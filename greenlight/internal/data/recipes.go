@@ -0,0 +1,574 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.dimash.net/internal/validator"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidRecipeMaterial = errors.New("crafting material does not exist")
+	ErrInvalidSubRecipe      = errors.New("sub-recipe does not exist")
+	ErrRecipeCycle           = errors.New("recipe cannot contain itself")
+	ErrRecipeInUse           = errors.New("recipe is used as a sub-recipe")
+	ErrCraftingMaterialInUse = errors.New("crafting material is used by a recipe")
+	ErrQuantityOutOfRange    = errors.New("quantity is out of range")
+)
+
+// The maximum number of materials, and separately of sub-recipes, in a recipe.
+const maxRecipeItems = 100
+
+// MaterialQuantity is a quantity of a single crafting material.
+type MaterialQuantity struct {
+	CraftingMaterialID int64 `json:"crafting_material_id"`
+	Quantity           int64 `json:"quantity"`
+}
+
+// RecipeQuantity is a quantity of a sub-recipe used as a component of another recipe.
+type RecipeQuantity struct {
+	RecipeID int64 `json:"recipe_id"`
+	Quantity int64 `json:"quantity"`
+}
+
+// Recipe is a bill of materials: the crafting materials, and the other recipes, needed
+// to craft one unit of it.
+type Recipe struct {
+	ID         int64              `json:"id"`
+	CreatedAt  time.Time          `json:"-"`
+	Name       string             `json:"name"`
+	Materials  []MaterialQuantity `json:"materials"`
+	SubRecipes []RecipeQuantity   `json:"sub_recipes"`
+	Version    int32              `json:"version"`
+}
+
+// RecipeRequirement is the total quantity of a crafting material needed to craft a
+// recipe once all of its sub-recipes have been expanded.
+type RecipeRequirement struct {
+	CraftingMaterialID int64  `json:"crafting_material_id"`
+	Title              string `json:"title"`
+	Quantity           int64  `json:"quantity"`
+	UnitPrice          Price  `json:"unit_price"`
+}
+
+// CraftableRecipe is a recipe along with the number of times it can be crafted from an
+// inventory.
+type CraftableRecipe struct {
+	RecipeID int64  `json:"recipe_id"`
+	Name     string `json:"name"`
+	Quantity int64  `json:"quantity"`
+}
+
+func ValidateRecipe(v *validator.Validator, recipe *Recipe) {
+	v.Check(recipe.Name != "", "name", "must be provided")
+	v.Check(len(recipe.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	v.Check(len(recipe.Materials)+len(recipe.SubRecipes) > 0, "materials", "must contain at least 1 material or sub-recipe")
+	ValidateMaterialQuantities(v, "materials", recipe.Materials)
+
+	v.Check(len(recipe.SubRecipes) <= maxRecipeItems, "sub_recipes", "must not contain more than 100 items")
+	ids := make([]string, len(recipe.SubRecipes))
+	for i, item := range recipe.SubRecipes {
+		ids[i] = strconv.FormatInt(item.RecipeID, 10)
+		v.Check(item.RecipeID > 0, "sub_recipes", "must only contain positive recipe ids")
+		v.Check(item.Quantity > 0, "sub_recipes", "must only contain positive quantities")
+		v.Check(recipe.ID == 0 || item.RecipeID != recipe.ID, "sub_recipes", "must not contain the recipe itself")
+	}
+	v.Check(validator.Unique(ids), "sub_recipes", "must not contain duplicate recipe ids")
+}
+
+// ValidateMaterialQuantities checks a list of crafting material quantities, such as the
+// materials of a recipe or an inventory.
+func ValidateMaterialQuantities(v *validator.Validator, key string, items []MaterialQuantity) {
+	v.Check(len(items) <= maxRecipeItems, key, "must not contain more than 100 items")
+
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = strconv.FormatInt(item.CraftingMaterialID, 10)
+		v.Check(item.CraftingMaterialID > 0, key, "must only contain positive crafting material ids")
+		v.Check(item.Quantity > 0, key, "must only contain positive quantities")
+	}
+	v.Check(validator.Unique(ids), key, "must not contain duplicate crafting material ids")
+}
+
+type RecipeModel struct {
+	DB *sql.DB
+}
+
+func (m RecipeModel) Insert(recipe *Recipe) error {
+	query := `
+	INSERT INTO recipes (name)
+	VALUES ($1)
+	RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, recipe.Name).Scan(&recipe.ID, &recipe.CreatedAt, &recipe.Version)
+	if err != nil {
+		return err
+	}
+
+	// A new recipe can't be part of a cycle, because nothing refers to it yet.
+	err = insertRecipeItems(ctx, tx, recipe)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m RecipeModel) Get(id int64) (*Recipe, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, name, version
+	FROM recipes
+	WHERE id = $1`
+
+	var recipe Recipe
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&recipe.ID,
+		&recipe.CreatedAt,
+		&recipe.Name,
+		&recipe.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = m.loadItems(ctx, []*Recipe{&recipe})
+	if err != nil {
+		return nil, err
+	}
+
+	return &recipe, nil
+}
+
+func (m RecipeModel) GetAll(name string, filters Filters) ([]*Recipe, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, created_at, name, version
+	FROM recipes
+	WHERE (STRPOS(LOWER(name), LOWER($1)) > 0 OR $1 = '')
+	ORDER BY %s
+	LIMIT $2 OFFSET $3`, filters.orderBy())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, name, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	recipes := []*Recipe{}
+
+	for rows.Next() {
+		var recipe Recipe
+
+		err := rows.Scan(
+			&totalRecords,
+			&recipe.ID,
+			&recipe.CreatedAt,
+			&recipe.Name,
+			&recipe.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		recipes = append(recipes, &recipe)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	err = m.loadItems(ctx, recipes)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return recipes, metadata, nil
+}
+
+// Update replaces the name and the items of a recipe. It returns ErrRecipeCycle if one
+// of the new sub-recipes contains the recipe, directly or further down.
+func (m RecipeModel) Update(recipe *Recipe) error {
+	cycleQuery := `
+	WITH RECURSIVE reachable (id) AS (
+		SELECT unnest($2::bigint[])
+		UNION
+		SELECT rs.sub_recipe_id
+		FROM recipe_subrecipes rs JOIN reachable r ON rs.recipe_id = r.id
+	)
+	SELECT EXISTS (SELECT 1 FROM reachable WHERE id = $1)`
+
+	query := `
+	UPDATE recipes
+	SET name = $1, version = version + 1
+	WHERE id = $2 AND version = $3
+	RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Stop the recipe graph from being changed by another request between the cycle
+	// check and the update, while still allowing it to be read.
+	_, err = tx.ExecContext(ctx, "LOCK TABLE recipe_subrecipes IN SHARE ROW EXCLUSIVE MODE")
+	if err != nil {
+		return err
+	}
+
+	if len(recipe.SubRecipes) > 0 {
+		ids := make([]int64, len(recipe.SubRecipes))
+		for i, item := range recipe.SubRecipes {
+			ids[i] = item.RecipeID
+		}
+
+		var cycle bool
+		err = tx.QueryRowContext(ctx, cycleQuery, recipe.ID, pq.Array(ids)).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrRecipeCycle
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, query, recipe.Name, recipe.ID, recipe.Version).Scan(&recipe.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recipe_materials WHERE recipe_id = $1", recipe.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recipe_subrecipes WHERE recipe_id = $1", recipe.ID)
+	if err != nil {
+		return err
+	}
+
+	err = insertRecipeItems(ctx, tx, recipe)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a recipe. A recipe which is a sub-recipe of another can't be deleted
+// and returns ErrRecipeInUse.
+func (m RecipeModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	DELETE FROM recipes
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		switch {
+		case isForeignKeyViolation(err):
+			return ErrRecipeInUse
+		default:
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// isOutOfRange reports whether err is PostgreSQL's error for a calculation whose
+// result doesn't fit in its type, such as a bigint overflow.
+func isOutOfRange(err error) bool {
+	return strings.HasPrefix(err.Error(), "pq: ") && strings.Contains(err.Error(), "out of range")
+}
+
+// Requirements expands a recipe and all of its sub-recipes into the total quantity of
+// each crafting material needed to craft it once, ordered by crafting material id.
+// ErrQuantityOutOfRange is returned if a total doesn't fit in a bigint.
+func (m RecipeModel) Requirements(id int64) ([]*RecipeRequirement, error) {
+	query := `
+	WITH RECURSIVE expanded (recipe_id, multiplier) AS (
+		SELECT $1::bigint, 1::bigint
+		UNION ALL
+		SELECT rs.sub_recipe_id, e.multiplier * rs.quantity
+		FROM recipe_subrecipes rs JOIN expanded e ON rs.recipe_id = e.recipe_id
+	)
+	SELECT cm.id, cm.title, cm.price, cm.price_currency, SUM(rm.quantity * e.multiplier)::bigint
+	FROM expanded e
+	JOIN recipe_materials rm ON rm.recipe_id = e.recipe_id
+	JOIN craftingmaterials cm ON cm.id = rm.crafting_material_id AND cm.deleted_at IS NULL
+	GROUP BY cm.id
+	ORDER BY cm.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		if isOutOfRange(err) {
+			return nil, ErrQuantityOutOfRange
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	requirements := []*RecipeRequirement{}
+
+	for rows.Next() {
+		var requirement RecipeRequirement
+
+		err := rows.Scan(
+			&requirement.CraftingMaterialID,
+			&requirement.Title,
+			&requirement.UnitPrice.Amount,
+			&requirement.UnitPrice.Currency,
+			&requirement.Quantity,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		requirements = append(requirements, &requirement)
+	}
+
+	if err = rows.Err(); err != nil {
+		if isOutOfRange(err) {
+			return nil, ErrQuantityOutOfRange
+		}
+		return nil, err
+	}
+
+	return requirements, nil
+}
+
+// Craftable returns every recipe which can be crafted at least once from the given
+// inventory, along with the number of times it can be crafted, ordered by recipe id.
+// Each recipe is considered on its own, so the quantities are not cumulative. Soft
+// deleted crafting materials in the inventory can't be crafted with.
+func (m RecipeModel) Craftable(inventory []MaterialQuantity) ([]*CraftableRecipe, error) {
+	// The quantities are multiplied as numerics, which can't overflow, so that one
+	// recipe with huge quantities doesn't break the query for every other recipe. The
+	// number of times a recipe can be crafted is at most an inventory quantity, so it
+	// fits in a bigint again.
+	query := `
+	WITH RECURSIVE expanded (root_id, recipe_id, multiplier) AS (
+		SELECT id, id, 1::numeric FROM recipes
+		UNION ALL
+		SELECT e.root_id, rs.sub_recipe_id, e.multiplier * rs.quantity
+		FROM recipe_subrecipes rs JOIN expanded e ON rs.recipe_id = e.recipe_id
+	),
+	requirements AS (
+		SELECT e.root_id, rm.crafting_material_id, SUM(rm.quantity * e.multiplier) AS needed
+		FROM expanded e JOIN recipe_materials rm ON rm.recipe_id = e.recipe_id
+		GROUP BY e.root_id, rm.crafting_material_id
+	),
+	inventory AS (
+		SELECT i.crafting_material_id, i.quantity
+		FROM unnest($1::bigint[], $2::bigint[]) AS i (crafting_material_id, quantity)
+		JOIN craftingmaterials cm ON cm.id = i.crafting_material_id AND cm.deleted_at IS NULL
+	)
+	SELECT r.id, r.name, MIN(div(COALESCE(i.quantity, 0), req.needed))::bigint AS craftable
+	FROM requirements req
+	JOIN recipes r ON r.id = req.root_id
+	LEFT JOIN inventory i ON i.crafting_material_id = req.crafting_material_id
+	GROUP BY r.id
+	HAVING MIN(div(COALESCE(i.quantity, 0), req.needed)) > 0
+	ORDER BY r.id`
+
+	ids := make([]int64, len(inventory))
+	quantities := make([]int64, len(inventory))
+	for i, item := range inventory {
+		ids[i] = item.CraftingMaterialID
+		quantities[i] = item.Quantity
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids), pq.Array(quantities))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipes := []*CraftableRecipe{}
+
+	for rows.Next() {
+		var recipe CraftableRecipe
+
+		err := rows.Scan(&recipe.RecipeID, &recipe.Name, &recipe.Quantity)
+		if err != nil {
+			return nil, err
+		}
+
+		recipes = append(recipes, &recipe)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipes, nil
+}
+
+// loadItems fills in the materials and sub-recipes of the given recipes.
+func (m RecipeModel) loadItems(ctx context.Context, recipes []*Recipe) error {
+	byID := make(map[int64]*Recipe, len(recipes))
+	ids := make([]int64, len(recipes))
+	for i, recipe := range recipes {
+		recipe.Materials = []MaterialQuantity{}
+		recipe.SubRecipes = []RecipeQuantity{}
+		byID[recipe.ID] = recipe
+		ids[i] = recipe.ID
+	}
+
+	if len(recipes) == 0 {
+		return nil
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `
+	SELECT recipe_id, crafting_material_id, quantity
+	FROM recipe_materials
+	WHERE recipe_id = ANY($1)
+	ORDER BY recipe_id, crafting_material_id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var recipeID int64
+		var item MaterialQuantity
+
+		if err := rows.Scan(&recipeID, &item.CraftingMaterialID, &item.Quantity); err != nil {
+			return err
+		}
+		byID[recipeID].Materials = append(byID[recipeID].Materials, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+	SELECT recipe_id, sub_recipe_id, quantity
+	FROM recipe_subrecipes
+	WHERE recipe_id = ANY($1)
+	ORDER BY recipe_id, sub_recipe_id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var recipeID int64
+		var item RecipeQuantity
+
+		if err := rows.Scan(&recipeID, &item.RecipeID, &item.Quantity); err != nil {
+			return err
+		}
+		byID[recipeID].SubRecipes = append(byID[recipeID].SubRecipes, item)
+	}
+
+	return rows.Err()
+}
+
+func insertRecipeItems(ctx context.Context, tx *sql.Tx, recipe *Recipe) error {
+	// Soft deleted crafting materials can't be added. The row is locked so that it
+	// can't be deleted until the transaction commits, which would otherwise slip past
+	// the check in deleteCraftingMaterial().
+	for _, item := range recipe.Materials {
+		result, err := tx.ExecContext(ctx, `
+		INSERT INTO recipe_materials (recipe_id, crafting_material_id, quantity)
+		SELECT $1, id, $3
+		FROM (
+			SELECT id FROM craftingmaterials
+			WHERE id = $2 AND deleted_at IS NULL
+			FOR SHARE
+		) AS cm`, recipe.ID, item.CraftingMaterialID, item.Quantity)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrInvalidRecipeMaterial
+		}
+	}
+
+	for _, item := range recipe.SubRecipes {
+		_, err := tx.ExecContext(ctx, `
+		INSERT INTO recipe_subrecipes (recipe_id, sub_recipe_id, quantity)
+		VALUES ($1, $2, $3)`, recipe.ID, item.RecipeID, item.Quantity)
+		if err != nil {
+			switch {
+			case strings.Contains(err.Error(), `"recipe_subrecipes_sub_recipe_id_fkey"`):
+				return ErrInvalidSubRecipe
+			default:
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,330 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrTokenReused = errors.New("refresh token reused")
+
+// A session is a token family: the short-lived access token and long-lived refresh
+// token issued at login, and every pair issued since by refreshing them. Refresh tokens
+// can only be used once, so a refresh token which is presented a second time must have
+// been copied, and the whole family is revoked.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+}
+
+// The longest User-Agent header stored with a session.
+const maxUserAgentLength = 512
+
+// NewSession starts a new token family for the user and returns its first access and
+// refresh tokens. The User-Agent of the client is recorded so that the session can be
+// recognised in the list of sessions. An accessTTL of zero issues no access token, for
+// callers which issue their own, such as signed JWTs.
+func (m TokenModel) NewSession(userID int64, userAgent string, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	// Cutting the header can split a multi-byte character, which PostgreSQL would
+	// reject, so any partial character left at the end is dropped.
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+
+	query := `
+	insert into token_families (user_id, user_agent)
+	values ($1, $2)
+	returning id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var familyID int64
+
+	err = tx.QueryRowContext(ctx, query, userID, userAgent).Scan(&familyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertSessionTokens(ctx, tx, userID, familyID, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, tx.Commit()
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token in the same
+// family, with accessTTL treated as for NewSession. ErrRecordNotFound is returned for
+// unknown and expired refresh tokens. If the refresh token has already been used its
+// family is revoked and ErrTokenReused is returned.
+func (m TokenModel) Refresh(refreshPlaintext string, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	refreshHash := sha256.Sum256([]byte(refreshPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Marking the token as used and reading it happen in one statement, so that two
+	// concurrent requests with the same token can't both succeed.
+	query := `
+	update tokens
+	set used_at = now()
+	where hash = $1 and scope = $2 and expiry > now() and used_at is null
+	returning user_id, family_id`
+
+	var userID, familyID int64
+
+	err = tx.QueryRowContext(ctx, query, refreshHash[:], ScopeRefresh).Scan(&userID, &familyID)
+	if err == nil {
+		access, refresh, err := insertSessionTokens(ctx, tx, userID, familyID, accessTTL, refreshTTL)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return access, refresh, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, err
+	}
+
+	query = `
+	delete from token_families
+	where id = (select family_id from tokens where hash = $1 and scope = $2 and used_at is not null)`
+
+	result, err := tx.ExecContext(ctx, query, refreshHash[:], ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rowsAffected == 0 {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nil, nil, ErrTokenReused
+}
+
+func insertSessionTokens(ctx context.Context, tx *sql.Tx, userID, familyID int64, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens := []*Token{refresh}
+
+	var access *Token
+	if accessTTL > 0 {
+		access, err = generateToken(userID, accessTTL, ScopeAuthentication)
+		if err != nil {
+			return nil, nil, err
+		}
+		tokens = append(tokens, access)
+	}
+
+	for _, token := range tokens {
+		token.FamilyID = &familyID
+
+		_, err = tx.ExecContext(ctx, insertTokenQuery, token.Hash, token.UserID, token.Expiry, token.Scope, token.FamilyID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return access, refresh, nil
+}
+
+// GetSessionsForUser returns the user's sessions which still hold an unused, unexpired
+// refresh token, newest first. The session which accessPlaintext belongs to, if any, is
+// marked as current.
+func (m TokenModel) GetSessionsForUser(userID int64, accessPlaintext string) ([]*Session, error) {
+	accessHash := sha256.Sum256([]byte(accessPlaintext))
+
+	query := `
+	select f.id, f.created_at, max(greatest(t.last_used_at, t.used_at)), 
+		max(t.expiry) filter (where t.scope = $2), f.user_agent, bool_or(t.hash = $3)
+	from token_families f
+	inner join tokens t on t.family_id = f.id
+	where f.user_id = $1
+	group by f.id
+	having bool_or(t.scope = $2 and t.used_at is null and t.expiry > now())
+	order by f.created_at desc, f.id desc`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeRefresh, accessHash[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession revokes one of the user's sessions, along with all of its tokens.
+func (m TokenModel) DeleteSession(userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	delete from token_families
+	where user_id = $1 and id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteSessionForToken revokes the session which an access token belongs to. Access
+// tokens issued before token families existed are revoked on their own.
+func (m TokenModel) DeleteSessionForToken(accessPlaintext string) error {
+	accessHash := sha256.Sum256([]byte(accessPlaintext))
+
+	query := `
+	with t as (
+		delete from tokens
+		where hash = $1 and scope = $2
+		returning family_id
+	), f as (
+		delete from token_families
+		where id in (select family_id from t)
+	)
+	select count(*) from t`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRowContext(ctx, query, accessHash[:], ScopeAuthentication).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllSessionsForUser revokes every session of the user, along with all of their
+// access and refresh tokens.
+func (m TokenModel) DeleteAllSessionsForUser(userID int64) error {
+	query := `
+	with f as (
+		delete from token_families
+		where user_id = $1
+	)
+	delete from tokens
+	where user_id = $1 and scope in ($2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, ScopeAuthentication, ScopeRefresh)
+	return err
+}
+
+// DeleteExpired deletes every expired token, and every session which no longer holds
+// an unused, unexpired refresh token, along with the rest of its tokens. It returns
+// the number of tokens and sessions deleted.
+func (m TokenModel) DeleteExpired() (int64, int64, error) {
+	// Both deletes see the tokens as they were before the statement ran, which is
+	// fine as the expired tokens the first one removes never count as live.
+	query := `
+	with t as (
+		delete from tokens
+		where expiry < now()
+		returning 1
+	), f as (
+		delete from token_families
+		where not exists (
+			select 1 from tokens
+			where tokens.family_id = token_families.id
+			and tokens.scope = $1 and tokens.used_at is null and tokens.expiry > now()
+		)
+		returning 1
+	)
+	select (select count(*) from t), (select count(*) from f)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var tokens, sessions int64
+
+	err := m.DB.QueryRowContext(ctx, query, ScopeRefresh).Scan(&tokens, &sessions)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return tokens, sessions, nil
+}
@@ -0,0 +1,230 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.dimash.net/internal/validator"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The maximum number of tags a crafting material can have.
+const maxTags = 20
+
+// Tag is a tag together with the number of crafting materials which carry it.
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NormalizeTag trims and lowercases a tag, so "Metal " and "metal" are the same tag.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// NormalizeTags normalizes each tag, drops duplicates and sorts the result. A nil
+// slice becomes an empty one, because the tags column is NOT NULL.
+func NormalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+
+	sort.Strings(normalized)
+	return normalized
+}
+
+func ValidateTag(v *validator.Validator, key, tag string) {
+	v.Check(tag != "", key, "must not contain empty tags")
+	v.Check(len(tag) <= 50, key, "must not contain tags more than 50 bytes long")
+}
+
+func ValidateTags(v *validator.Validator, key string, tags []string) {
+	v.Check(len(tags) <= maxTags, key, "must not contain more than 20 tags")
+	for _, tag := range tags {
+		ValidateTag(v, key, tag)
+	}
+}
+
+// Tags returns every tag in use by a crafting material which hasn't been soft deleted,
+// ordered by name.
+func (m CraftingMaterialModel) Tags() ([]*Tag, error) {
+	query := `
+	SELECT tag, count(*)
+	FROM craftingmaterials, unnest(tags) AS tag
+	WHERE deleted_at IS NULL
+	GROUP BY tag
+	ORDER BY tag`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []*Tag{}
+
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, &tag)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// RenameTag replaces a tag with another on every crafting material which carries it
+// and isn't soft deleted, merging the two if a crafting material already has the new
+// tag, and records the change to each one in the history as made by the user. It
+// returns the number of crafting materials changed, or ErrRecordNotFound if none
+// carried the tag.
+func (m CraftingMaterialModel) RenameTag(oldTag, newTag string, userID int64) (int64, error) {
+	tags := "ARRAY(SELECT DISTINCT t FROM unnest(array_replace(tags, $1, $2)) AS t ORDER BY t)"
+
+	return m.updateTags(tags, userID, oldTag, newTag)
+}
+
+// RemoveTag removes a tag from every crafting material which carries it and isn't soft
+// deleted, recording the change to each one in the history as made by the user. It
+// returns the number of crafting materials changed, or ErrRecordNotFound if none
+// carried the tag.
+func (m CraftingMaterialModel) RemoveTag(tag string, userID int64) (int64, error) {
+	return m.updateTags("array_remove(tags, $1)", userID, tag)
+}
+
+// updateTags sets the tags of every crafting material carrying the tag in args[0] to
+// the given SQL expression, which may refer to args as $1, $2 and so on. Soft deleted
+// crafting materials are left as they were deleted, so that restoring one brings back
+// the values recorded in its history.
+func (m CraftingMaterialModel) updateTags(tags string, userID int64, args ...interface{}) (int64, error) {
+	// Lock the crafting materials while reading their old values, so that they can't
+	// change before the update.
+	selectQuery := `
+	SELECT id, title, year, price, price_currency, category_id, tags
+	FROM craftingmaterials
+	WHERE tags @> ARRAY[$1::text] AND deleted_at IS NULL
+	ORDER BY id
+	FOR UPDATE`
+
+	updateQuery := fmt.Sprintf(`
+	UPDATE craftingmaterials
+	SET tags = %s, version = version + 1
+	WHERE id = ANY($%d)
+	RETURNING id, version, tags`, tags, len(args)+1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, selectQuery, args[0])
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	oldValues := make(map[int64]*CraftingMaterialSnapshot)
+
+	for rows.Next() {
+		var material CraftingMaterials
+
+		err := rows.Scan(
+			&material.ID,
+			&material.Title,
+			&material.Year,
+			&material.Price.Amount,
+			&material.Price.Currency,
+			&material.CategoryID,
+			pq.Array(&material.Tags),
+		)
+		if err != nil {
+			return 0, err
+		}
+
+		ids = append(ids, material.ID)
+		oldValues[material.ID] = material.Snapshot()
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, ErrRecordNotFound
+	}
+
+	rows, err = tx.QueryContext(ctx, updateQuery, append(args, pq.Array(ids))...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var revisions []*CraftingMaterialRevision
+
+	for rows.Next() {
+		var (
+			id      int64
+			version int32
+			newTags []string
+		)
+
+		if err := rows.Scan(&id, &version, pq.Array(&newTags)); err != nil {
+			return 0, err
+		}
+
+		newValues := *oldValues[id]
+		newValues.Tags = newTags
+
+		revisions = append(revisions, &CraftingMaterialRevision{
+			CraftingMaterialID: id,
+			Version:            version,
+			Action:             HistoryActionUpdate,
+			UserID:             &userID,
+			OldValues:          oldValues[id],
+			NewValues:          &newValues,
+		})
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// The revisions can only be inserted once the rows of the update have been read.
+	rows.Close()
+
+	for _, revision := range revisions {
+		err := insertRevision(ctx, tx, revision)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(revisions)), nil
+}
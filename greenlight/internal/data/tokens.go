@@ -13,6 +13,9 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeTwoFactor      = "two-factor"
 )
 
 type Token struct {
@@ -21,6 +24,7 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	FamilyID  *int64    `json:"-"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -64,17 +68,17 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
-	query := `
-	insert into tokens (hash, user_id, expiry, scope) 
-	values ($1, $2, $3, $4)`
+const insertTokenQuery = `
+	insert into tokens (hash, user_id, expiry, scope, family_id) 
+	values ($1, $2, $3, $4, $5)`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+func (m TokenModel) Insert(token *Token) error {
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.FamilyID}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	_, err := m.DB.ExecContext(ctx, insertTokenQuery, args...)
 	return err
 }
 
@@ -89,3 +93,20 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// Touch records that an authentication token has just been used. The time is only
+// updated once a minute, so that busy clients don't cause a write on every request.
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	update tokens
+	set last_used_at = now()
+	where hash = $1 and (last_used_at is null or last_used_at < now() - interval '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	return err
+}
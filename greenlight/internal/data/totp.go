@@ -0,0 +1,281 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication already enabled")
+	ErrTOTPCodeReused     = errors.New("TOTP code already used")
+)
+
+// The number of recovery codes issued when two-factor authentication is enabled.
+const recoveryCodeCount = 10
+
+// TOTP is a user's two-factor authentication secret. Until EnabledAt is set the secret
+// is only pending: the user has been given it but hasn't yet proved that their
+// authenticator app produces the right codes. The secret has to be stored as is, since
+// codes are computed from it. LastCounter is the counter of the last code accepted.
+type TOTP struct {
+	UserID      int64
+	Secret      string
+	CreatedAt   time.Time
+	EnabledAt   *time.Time
+	LastCounter int64
+}
+
+func (t *TOTP) Enabled() bool {
+	return t.EnabledAt != nil
+}
+
+// GenerateRecoveryCodes returns a new set of recovery codes, formatted like
+// "k3v9q-x7m2p", along with the hashes which are stored in their place.
+func GenerateRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case, dashes and spaces so that the
+// code can be typed in however is convenient.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+	SELECT user_id, secret, created_at, enabled_at, last_counter
+	FROM user_totp
+	WHERE user_id = $1`
+
+	var t TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&t.UserID,
+		&t.Secret,
+		&t.CreatedAt,
+		&t.EnabledAt,
+		&t.LastCounter,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// Enabled reports whether the user has two-factor authentication turned on.
+func (m TOTPModel) Enabled(userID int64) (bool, error) {
+	t, err := m.Get(userID)
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return t.Enabled(), nil
+}
+
+// SetPending stores a new pending secret for the user, replacing any earlier pending
+// one. ErrTOTPAlreadyEnabled is returned if two-factor authentication is already on.
+func (m TOTPModel) SetPending(userID int64, secret string) error {
+	query := `
+	INSERT INTO user_totp (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id)
+	DO UPDATE SET secret = EXCLUDED.secret, created_at = NOW(), last_counter = 0
+	WHERE user_totp.enabled_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	return nil
+}
+
+// Enable turns on two-factor authentication with the user's pending secret, after a
+// code with the given counter has been checked against it, and replaces the user's
+// recovery codes.
+func (m TOTPModel) Enable(userID, counter int64, recoveryCodeHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE user_totp
+	SET enabled_at = NOW(), last_counter = $2
+	WHERE user_id = $1 AND enabled_at IS NULL`
+
+	result, err := tx.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseCounter records that a code with the given counter has been accepted. If a code
+// with the same or a later counter has already been accepted, ErrTOTPCodeReused is
+// returned and the code must be refused.
+func (m TOTPModel) UseCounter(userID, counter int64) error {
+	query := `
+	UPDATE user_totp
+	SET last_counter = $2
+	WHERE user_id = $1 AND enabled_at IS NOT NULL AND last_counter < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTOTPCodeReused
+	}
+
+	return nil
+}
+
+// UseRecoveryCode deletes one of the user's recovery codes, so that it can't be used
+// again. ErrRecordNotFound is returned if the user has no such code.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) error {
+	query := `
+	DELETE FROM user_recovery_codes
+	WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RecoveryCodesRemaining returns how many unused recovery codes the user has.
+func (m TOTPModel) RecoveryCodesRemaining(userID int64) (int, error) {
+	query := `
+	SELECT count(*)
+	FROM user_recovery_codes
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// Disable turns off two-factor authentication for the user and deletes their secret
+// and recovery codes.
+func (m TOTPModel) Disable(userID int64) error {
+	query := `
+	WITH c AS (
+		DELETE FROM user_recovery_codes
+		WHERE user_id = $1
+	)
+	DELETE FROM user_totp
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestDB connects to the database named by GREENLIGHT_TEST_DB_DSN, which must have
+// the migrations applied. Tests which need it are skipped when it isn't set.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = db.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// newTestUser inserts a user, which is deleted along with everything that refers to it
+// when the test finishes.
+func newTestUser(t *testing.T, db *sql.DB) *User {
+	t.Helper()
+
+	user := &User{
+		Name:  "Test User",
+		Email: fmt.Sprintf("test-%d@example.com", time.Now().UnixNano()),
+	}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = UserModel{DB: db}.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM users WHERE id = $1`, user.ID)
+	})
+
+	return user
+}
+
+func TestTOTPUseCounterRefusesReplays(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db)
+	m := TOTPModel{DB: db}
+
+	err := m.SetPending(user.ID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Enable(user.ID, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		counter int64
+		want    error
+	}{
+		{"counter used to enable", 100, ErrTOTPCodeReused},
+		{"earlier counter", 99, ErrTOTPCodeReused},
+		{"next counter", 101, nil},
+		{"same counter again", 101, ErrTOTPCodeReused},
+		{"counter skipped ahead", 103, nil},
+		{"counter skipped over", 102, ErrTOTPCodeReused},
+	}
+
+	for _, tt := range tests {
+		err := m.UseCounter(user.ID, tt.counter)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got error %v; want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestTOTPUseCounterRefusesPendingSecrets(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db)
+	m := TOTPModel{DB: db}
+
+	err := m.SetPending(user.ID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.UseCounter(user.ID, 1)
+	if !errors.Is(err, ErrTOTPCodeReused) {
+		t.Errorf("got error %v; want %v", err, ErrTOTPCodeReused)
+	}
+}
+
+func TestTOTPUseRecoveryCodeOnlyOnce(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db)
+	m := TOTPModel{DB: db}
+
+	err := m.SetPending(user.ID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Enable(user.ID, 1, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.UseRecoveryCode(user.ID, codes[0])
+	if err != nil {
+		t.Fatalf("first use: got error %v; want nil", err)
+	}
+
+	err = m.UseRecoveryCode(user.ID, codes[0])
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("second use: got error %v; want %v", err, ErrRecordNotFound)
+	}
+}
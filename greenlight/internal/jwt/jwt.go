@@ -0,0 +1,162 @@
+// Package jwt signs and verifies compact JSON Web Tokens with the HS256 and EdDSA
+// (Ed25519) algorithms, using only the standard library.
+package jwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+	ErrUnknownKey   = errors.New("token was signed with an unknown key")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Claims holds the registered claims which Verify checks. Applications embed it in
+// their own claims struct alongside any private claims.
+type Claims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Expiry    int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid"`
+}
+
+// KeySet holds the keys tokens are verified with, looked up by the "kid" header, and
+// the key new tokens are signed with. To rotate keys, add the new key and make it the
+// signing key, then remove the old key once every token it signed has expired.
+type KeySet struct {
+	signingKey *Key
+	keys       map[string]*Key
+}
+
+// NewKeySet returns a KeySet which signs with the key whose id is signingKeyID.
+func NewKeySet(signingKeyID string, keys ...*Key) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*Key, len(keys))}
+
+	for _, key := range keys {
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	ks.signingKey = ks.keys[signingKeyID]
+	if ks.signingKey == nil {
+		return nil, fmt.Errorf("signing key %q not found", signingKeyID)
+	}
+	if !ks.signingKey.CanSign() {
+		return nil, fmt.Errorf("signing key %q: %w", signingKeyID, ErrVerifyOnly)
+	}
+
+	return ks, nil
+}
+
+// Sign encodes claims, which should embed Claims, as JSON and returns a token signed
+// with the signing key.
+func (ks *KeySet) Sign(claims interface{}) (string, error) {
+	h, err := json.Marshal(header{Alg: ks.signingKey.Alg, Typ: "JWT", Kid: ks.signingKey.ID})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+
+	signature, err := ks.signingKey.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the token's signature and that it is valid at the given time, then
+// decodes its payload into claims, which should embed Claims. Tokens without an
+// expiry are rejected.
+func (ks *KeySet) Verify(token string, now time.Time, claims interface{}) error {
+	parts := bytes.Split([]byte(token), []byte("."))
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	var h header
+	err := decodeSegment(parts[0], &h)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	key := ks.keys[h.Kid]
+	if key == nil {
+		return ErrUnknownKey
+	}
+
+	// The algorithm is fixed by the key rather than trusted from the header, so a
+	// token can't switch to a weaker algorithm or to "none".
+	if h.Alg != key.Alg {
+		return ErrInvalidToken
+	}
+
+	signature := make([]byte, encoding.DecodedLen(len(parts[2])))
+	n, err := encoding.Decode(signature, parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	signingInput := token[:len(parts[0])+1+len(parts[1])]
+	if !key.verify([]byte(signingInput), signature[:n]) {
+		return ErrInvalidToken
+	}
+
+	var registered Claims
+	err = decodeSegment(parts[1], &registered)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if registered.Expiry == 0 {
+		return ErrInvalidToken
+	}
+	if now.Unix() >= registered.Expiry {
+		return ErrExpiredToken
+	}
+	if registered.NotBefore != 0 && now.Unix() < registered.NotBefore {
+		return ErrInvalidToken
+	}
+
+	err = decodeSegment(parts[1], claims)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+func decodeSegment(segment []byte, dst interface{}) error {
+	b := make([]byte, encoding.DecodedLen(len(segment)))
+
+	n, err := encoding.Decode(b, segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b[:n], dst)
+}
@@ -0,0 +1,304 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	Claims
+	Name string `json:"name"`
+}
+
+func newHMACKey(t *testing.T, id string) *Key {
+	t.Helper()
+
+	return &Key{ID: id, Alg: AlgHS256, secret: []byte(strings.Repeat("s", minSecretLength))}
+}
+
+func newEdDSAKey(t *testing.T, id string) *Key {
+	t.Helper()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Key{ID: id, Alg: AlgEdDSA, privateKey: privateKey, publicKey: publicKey}
+}
+
+func newKeySet(t *testing.T, signingKeyID string, keys ...*Key) *KeySet {
+	t.Helper()
+
+	ks, err := NewKeySet(signingKeyID, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ks
+}
+
+// forge returns a token with the given header and claims, signed with key whatever
+// algorithm the header names.
+func forge(t *testing.T, h header, claims interface{}, key *Key) string {
+	t.Helper()
+
+	signingInput := encodeSegment(t, h) + "." + encodeSegment(t, claims)
+
+	signature, err := key.sign([]byte(signingInput))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature)
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoding.EncodeToString(b)
+}
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	for _, key := range []*Key{newHMACKey(t, "hmac"), newEdDSAKey(t, "ed")} {
+		t.Run(key.Alg, func(t *testing.T) {
+			ks := newKeySet(t, key.ID, key)
+
+			token, err := ks.Sign(testClaims{Claims: Claims{Subject: "42", Expiry: now.Add(time.Minute).Unix()}, Name: "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var claims testClaims
+			err = ks.Verify(token, now, &claims)
+			if err != nil {
+				t.Fatalf("got error %v; want nil", err)
+			}
+
+			if claims.Subject != "42" || claims.Name != "alice" {
+				t.Errorf("got claims %+v; want subject 42 and name alice", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyTimes(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	ks := newKeySet(t, "hmac", newHMACKey(t, "hmac"))
+
+	tests := []struct {
+		name   string
+		claims Claims
+		want   error
+	}{
+		{"valid", Claims{Expiry: now.Unix() + 1}, nil},
+		{"no expiry", Claims{}, ErrInvalidToken},
+		{"expired", Claims{Expiry: now.Unix() - 1}, ErrExpiredToken},
+		{"expires now", Claims{Expiry: now.Unix()}, ErrExpiredToken},
+		{"not yet valid", Claims{Expiry: now.Unix() + 60, NotBefore: now.Unix() + 1}, ErrInvalidToken},
+		{"valid from now", Claims{Expiry: now.Unix() + 60, NotBefore: now.Unix()}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := ks.Sign(tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var claims Claims
+			err = ks.Verify(token, now, &claims)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v; want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsUnknownKey(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	signer := newKeySet(t, "old", newHMACKey(t, "old"))
+	verifier := newKeySet(t, "new", newHMACKey(t, "new"))
+
+	token, err := signer.Sign(Claims{Expiry: now.Unix() + 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var claims Claims
+	err = verifier.Verify(token, now, &claims)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got error %v; want %v", err, ErrUnknownKey)
+	}
+}
+
+// An HS256 token whose kid names an Ed25519 key, signed with the public key as the
+// HMAC secret, must not be accepted, since the public key isn't secret.
+func TestVerifyRejectsAlgorithmMismatch(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	edKey := newEdDSAKey(t, "ed")
+	ks := newKeySet(t, "ed", edKey)
+
+	hmacKey := &Key{ID: "ed", Alg: AlgHS256, secret: []byte(edKey.publicKey)}
+	claims := Claims{Expiry: now.Unix() + 60}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"HS256", forge(t, header{Alg: AlgHS256, Typ: "JWT", Kid: "ed"}, claims, hmacKey)},
+		{"none", forge(t, header{Alg: "none", Typ: "JWT", Kid: "ed"}, claims, hmacKey)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Claims
+			err := ks.Verify(tt.token, now, &got)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsBadSignatures(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	for _, key := range []*Key{newHMACKey(t, "k"), newEdDSAKey(t, "k")} {
+		t.Run(key.Alg, func(t *testing.T) {
+			ks := newKeySet(t, "k", key)
+
+			token, err := ks.Sign(testClaims{Claims: Claims{Subject: "42", Expiry: now.Unix() + 60}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := strings.Split(token, ".")
+
+			otherPayload := encodeSegment(t, testClaims{Claims: Claims{Subject: "1", Expiry: now.Unix() + 60}})
+
+			signature, err := encoding.DecodeString(parts[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			signature[0] ^= 0xff
+
+			tests := []struct {
+				name  string
+				token string
+			}{
+				{"changed payload", parts[0] + "." + otherPayload + "." + parts[2]},
+				{"changed signature", parts[0] + "." + parts[1] + "." + encoding.EncodeToString(signature)},
+				{"truncated signature", parts[0] + "." + parts[1] + "." + encoding.EncodeToString(signature[:len(signature)/2])},
+				{"no signature", parts[0] + "." + parts[1] + "."},
+				{"malformed signature", parts[0] + "." + parts[1] + ".!!!"},
+				{"two segments", parts[0] + "." + parts[1]},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					var claims testClaims
+					err := ks.Verify(tt.token, now, &claims)
+					if !errors.Is(err, ErrInvalidToken) {
+						t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestVerifyOnlyKeys(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	dir := t.TempDir()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privatePath := filepath.Join(dir, "private.pem")
+	publicPath := filepath.Join(dir, "public.pem")
+
+	err = os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingKey, err := LoadKey("old", privatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyOnlyKey, err := LoadKey("old", publicPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verifyOnlyKey.CanSign() {
+		t.Fatal("public key can sign; want verify only")
+	}
+
+	_, err = NewKeySet("old", verifyOnlyKey)
+	if !errors.Is(err, ErrVerifyOnly) {
+		t.Errorf("got error %v making a public key the signing key; want %v", err, ErrVerifyOnly)
+	}
+
+	// A token signed before the key was retired is still accepted by a key set which
+	// only has its public half.
+	token, err := newKeySet(t, "old", signingKey).Sign(Claims{Expiry: now.Unix() + 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := newKeySet(t, "new", newHMACKey(t, "new"), verifyOnlyKey)
+
+	var claims Claims
+	err = ks.Verify(token, now, &claims)
+	if err != nil {
+		t.Errorf("got error %v verifying with a public key; want nil", err)
+	}
+}
+
+func TestLoadKeyRejectsShortSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+
+	err := os.WriteFile(path, []byte(strings.Repeat("s", minSecretLength-1)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadKey("k", path)
+	if err == nil {
+		t.Error("got nil error for a short HMAC secret; want an error")
+	}
+}
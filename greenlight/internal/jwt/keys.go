@@ -0,0 +1,110 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// The supported signing algorithms, as named in the "alg" header.
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// The shortest HMAC secret accepted, which matches the size of the SHA-256 output.
+const minSecretLength = 32
+
+var ErrVerifyOnly = errors.New("key can only be used for verification")
+
+// Key is a named signing or verification key. HMAC keys and Ed25519 private keys can
+// both sign and verify, while Ed25519 public keys can only verify. Keeping the public
+// half of a retired key allows tokens signed with it to be accepted until they expire.
+type Key struct {
+	ID         string
+	Alg        string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// LoadKey reads a key from a file. A PEM encoded PKCS #8 "PRIVATE KEY" or PKIX
+// "PUBLIC KEY" block is read as an Ed25519 key, and anything else as an HMAC secret,
+// ignoring leading and trailing whitespace.
+func LoadKey(id, path string) (*Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == "" {
+		return nil, errors.New("key id must not be empty")
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		secret := bytes.TrimSpace(b)
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("key %q: HMAC secret must be at least %d bytes long", id, minSecretLength)
+		}
+		return &Key{ID: id, Alg: AlgHS256, secret: secret}, nil
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		privateKey, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key %q: only Ed25519 private keys are supported", id)
+		}
+		return &Key{ID: id, Alg: AlgEdDSA, privateKey: privateKey, publicKey: privateKey.Public().(ed25519.PublicKey)}, nil
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		publicKey, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key %q: only Ed25519 public keys are supported", id)
+		}
+		return &Key{ID: id, Alg: AlgEdDSA, publicKey: publicKey}, nil
+	default:
+		return nil, fmt.Errorf("key %q: unsupported PEM block type %q", id, block.Type)
+	}
+}
+
+// CanSign reports whether the key can be used to sign tokens.
+func (k *Key) CanSign() bool {
+	return k.secret != nil || k.privateKey != nil
+}
+
+func (k *Key) sign(signingInput []byte) ([]byte, error) {
+	switch {
+	case k.secret != nil:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signingInput)
+		return mac.Sum(nil), nil
+	case k.privateKey != nil:
+		return ed25519.Sign(k.privateKey, signingInput), nil
+	default:
+		return nil, ErrVerifyOnly
+	}
+}
+
+func (k *Key) verify(signingInput, signature []byte) bool {
+	if k.secret != nil {
+		expected, _ := k.sign(signingInput)
+		return hmac.Equal(signature, expected)
+	}
+
+	return len(signature) == ed25519.SignatureSize && ed25519.Verify(k.publicKey, signingInput, signature)
+}
@@ -0,0 +1,200 @@
+package rates
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"greenlight.dimash.net/internal/jsonlog"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileProvider reads exchange rates from a local file, so that conversion works without
+// any network access. The file is checked for changes at most once per checkInterval
+// and reloaded when its modification time changes.
+//
+// A JSON file holds the rates against a base currency:
+//
+//	{"base": "USD", "rates": {"EUR": 0.92, "KZT": 450.5}}
+//
+// A file with the .csv extension holds one "currency,rate" row per currency against
+// USD, with an optional "currency,rate" header row.
+//
+// If the file can't be read or parsed when it changes, the previous rates are kept
+// and the error is written to the logger.
+type FileProvider struct {
+	path          string
+	checkInterval time.Duration
+	logger        *jsonlog.Logger
+
+	mu        sync.RWMutex
+	rates     map[string]float64
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewFileProvider loads the rates from the file at path, returning an error if it
+// can't be read.
+func NewFileProvider(path string, checkInterval time.Duration, logger *jsonlog.Logger) (*FileProvider, error) {
+	p := &FileProvider{
+		path:          path,
+		checkInterval: checkInterval,
+		logger:        logger,
+	}
+
+	err := p.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *FileProvider) Rate(from, to string) (float64, error) {
+	p.reloadIfChanged()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	fromRate, ok := p.rates[from]
+	if !ok {
+		return 0, fmt.Errorf("%w %s", ErrUnknownCurrency, from)
+	}
+
+	toRate, ok := p.rates[to]
+	if !ok {
+		return 0, fmt.Errorf("%w %s", ErrUnknownCurrency, to)
+	}
+
+	// Both rates are against the same base currency.
+	return toRate / fromRate, nil
+}
+
+// reloadIfChanged reloads the file if it has been modified since it was last read. If
+// the file can't be read or the new file can't be parsed, the previous rates are kept
+// and the error is logged.
+func (p *FileProvider) reloadIfChanged() {
+	p.mu.Lock()
+	if time.Since(p.lastCheck) < p.checkInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.lastCheck = time.Now()
+	modTime := p.modTime
+	p.mu.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		p.logError(err)
+		return
+	}
+
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+
+	err = p.reload()
+	if err != nil {
+		p.logError(err)
+	}
+}
+
+func (p *FileProvider) logError(err error) {
+	if p.logger != nil {
+		p.logger.PrintError(err, map[string]string{"rates_file": p.path})
+	}
+}
+
+func (p *FileProvider) reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var rates map[string]float64
+	if strings.EqualFold(filepath.Ext(p.path), ".csv") {
+		rates, err = parseCSV(f)
+	} else {
+		rates, err = parseJSON(f)
+	}
+	if err != nil {
+		return fmt.Errorf("rates file %s: %w", p.path, err)
+	}
+
+	p.mu.Lock()
+	p.rates = rates
+	p.modTime = info.ModTime()
+	p.lastCheck = time.Now()
+	p.mu.Unlock()
+
+	return nil
+}
+
+func parseJSON(r io.Reader) (map[string]float64, error) {
+	var input struct {
+		Base  string             `json:"base"`
+		Rates map[string]float64 `json:"rates"`
+	}
+
+	err := json.NewDecoder(r).Decode(&input)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.Base == "" {
+		return nil, errors.New("missing base currency")
+	}
+
+	rates := map[string]float64{strings.ToUpper(input.Base): 1}
+	for currency, rate := range input.Rates {
+		if rate <= 0 {
+			return nil, fmt.Errorf("rate for %s must be positive", currency)
+		}
+		rates[strings.ToUpper(currency)] = rate
+	}
+
+	return rates, nil
+}
+
+func parseCSV(r io.Reader) (map[string]float64, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	rates := map[string]float64{"USD": 1}
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if line == 1 && strings.EqualFold(record[0], "currency") {
+			continue
+		}
+
+		rate, err := strconv.ParseFloat(record[1], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("line %d: rate must be a positive number", line)
+		}
+
+		rates[strings.ToUpper(record[0])] = rate
+	}
+
+	return rates, nil
+}
@@ -0,0 +1,13 @@
+package rates
+
+import (
+	"errors"
+)
+
+var ErrUnknownCurrency = errors.New("no exchange rate for currency")
+
+// Provider looks up exchange rates. Rate returns how many units of the to currency one
+// unit of the from currency is worth.
+type Provider interface {
+	Rate(from, to string) (float64, error)
+}
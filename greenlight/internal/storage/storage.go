@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+// Store saves and loads binary objects, such as uploaded attachments, by key. Keys are
+// slash separated paths like "attachments/12/3f9a.pdf".
+type Store interface {
+	// Put writes everything read from r to the object with the given key, replacing
+	// any existing object, and returns the number of bytes written.
+	Put(key string, r io.Reader) (int64, error)
+	// Open returns a reader for the object with the given key, or ErrNotFound.
+	Open(key string) (io.ReadCloser, error)
+	// Delete removes the object with the given key. Deleting a missing object is not
+	// an error.
+	Delete(key string) error
+}
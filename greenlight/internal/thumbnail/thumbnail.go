@@ -0,0 +1,104 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+)
+
+// ErrTooLarge is returned for images whose dimensions exceed MaxPixels, so that a small
+// but highly compressed file can't make the server decode an enormous bitmap.
+var ErrTooLarge = errors.New("image is too large to thumbnail")
+
+// MaxPixels is the largest width*height of an image which will be decoded. A decoded
+// image takes up to 8 bytes per pixel, so this caps a single decode at 128MB.
+const MaxPixels = 16_000_000
+
+// The number of source samples taken along each axis for every thumbnail pixel.
+const samples = 4
+
+// Generate decodes a JPEG, PNG or GIF image from src and writes a PNG thumbnail which
+// fits within size x size pixels to dst, keeping the aspect ratio. Images which already
+// fit are not enlarged.
+func Generate(dst io.Writer, src io.Reader, size int) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if config.Width*config.Height > MaxPixels {
+		return ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	return png.Encode(dst, scale(img, size))
+}
+
+// scale shrinks img to fit within size x size pixels, averaging a grid of samples from
+// the source image for each pixel of the result.
+func scale(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width <= size && height <= size {
+		return img
+	}
+
+	dstWidth, dstHeight := size, size
+	if width > height {
+		dstHeight = height * size / width
+	} else {
+		dstWidth = width * size / height
+	}
+	if dstWidth < 1 {
+		dstWidth = 1
+	}
+	if dstHeight < 1 {
+		dstHeight = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var r, g, b, a uint32
+
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					srcX := bounds.Min.X + ((x*samples+sx)*width)/(dstWidth*samples)
+					srcY := bounds.Min.Y + ((y*samples+sy)*height)/(dstHeight*samples)
+
+					cr, cg, cb, ca := img.At(srcX, srcY).RGBA()
+					r += cr
+					g += cg
+					b += cb
+					a += ca
+				}
+			}
+
+			n := uint32(samples * samples)
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
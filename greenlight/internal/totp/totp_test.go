@@ -0,0 +1,121 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors from appendix B of RFC 6238, whose secret is the ASCII string
+// "12345678901234567890". The RFC gives 8 digit codes, and a 6 digit code is the last
+// 6 digits of the 8 digit one.
+func TestCodeRFC6238(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	if secret != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" {
+		t.Fatalf("got secret %q; want GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", secret)
+	}
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(secret, Counter(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tt.want {
+			t.Errorf("Code at %d: got %q; want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCodeAcceptsLowerCaseSecrets(t *testing.T) {
+	got, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", Counter(time.Unix(59, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "287082" {
+		t.Errorf("got %q; want %q", got, "287082")
+	}
+}
+
+func TestCodeRejectsInvalidSecrets(t *testing.T) {
+	for _, secret := range []string{"", "not base32!"} {
+		_, err := Code(secret, 1)
+		if err != ErrInvalidSecret {
+			t.Errorf("Code(%q): got error %v; want %v", secret, err, ErrInvalidSecret)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	counter := Counter(now)
+
+	tests := []struct {
+		name    string
+		counter int64
+		ok      bool
+	}{
+		{"current period", counter, true},
+		{"previous period", counter - 1, true},
+		{"next period", counter + 1, true},
+		{"two periods ago", counter - 2, false},
+		{"two periods ahead", counter + 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := Code(secret, tt.counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The matched counter is what callers store to refuse replays, so it
+			// must be the code's own counter rather than the current one.
+			got, ok := Validate(secret, code, now)
+			if ok != tt.ok {
+				t.Fatalf("got ok %t; want %t", ok, tt.ok)
+			}
+			if ok && got != tt.counter {
+				t.Errorf("got counter %d; want %d", got, tt.counter)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedCodes(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	now := time.Unix(59, 0)
+
+	for _, code := range []string{"", "28708", "2870820", "94287082"} {
+		if _, ok := Validate(secret, code, now); ok {
+			t.Errorf("Validate(%q): got ok; want not ok", code)
+		}
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("Green Light", "alice+test@example.com", "GEZDGNBVGY3TQOJQ")
+	want := "otpauth://totp/Green%20Light:alice+test@example.com?algorithm=SHA1&digits=6&issuer=Green%20Light&period=30&secret=GEZDGNBVGY3TQOJQ"
+
+	if got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code IN ('movies:read', 'movies:write');
+DROP TABLE IF EXISTS movies;
\ No newline at end of file
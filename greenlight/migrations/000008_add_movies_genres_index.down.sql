@@ -0,0 +1 @@
+DROP INDEX IF EXISTS movies_genres_idx;
\ No newline at end of file
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS movies_genres_idx ON movies USING GIN (genres);
\ No newline at end of file
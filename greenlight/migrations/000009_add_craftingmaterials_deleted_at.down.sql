@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'craftingmaterials:admin';
+DROP INDEX IF EXISTS craftingmaterials_deleted_at_idx;
+ALTER TABLE craftingmaterials DROP COLUMN IF EXISTS deleted_at;
\ No newline at end of file
@@ -0,0 +1,5 @@
+ALTER TABLE craftingmaterials ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS craftingmaterials_deleted_at_idx ON craftingmaterials (deleted_at) WHERE deleted_at IS NOT NULL;
+
+INSERT INTO permissions (code)
+VALUES ('craftingmaterials:admin');
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS craftingmaterials_history;
\ No newline at end of file
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS craftingmaterials_history (
+    id bigserial PRIMARY KEY,
+    crafting_material_id bigint NOT NULL,
+    version integer NOT NULL,
+    action text NOT NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    old_values jsonb,
+    new_values jsonb
+);
+
+-- crafting_material_id isn't a foreign key, so that the history of a crafting material
+-- is kept after it's purged.
+CREATE INDEX IF NOT EXISTS craftingmaterials_history_crafting_material_id_idx ON craftingmaterials_history (crafting_material_id, version);
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS craftingmaterials_price_currency_idx;
+ALTER TABLE craftingmaterials DROP COLUMN IF EXISTS price_currency;
+ALTER TABLE craftingmaterials ALTER COLUMN price TYPE integer USING (price / 100)::integer;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE craftingmaterials ALTER COLUMN price TYPE bigint USING price::bigint * 100;
+ALTER TABLE craftingmaterials ADD COLUMN IF NOT EXISTS price_currency char(3) NOT NULL DEFAULT 'USD';
+CREATE INDEX IF NOT EXISTS craftingmaterials_price_currency_idx ON craftingmaterials (price_currency, price);
\ No newline at end of file
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS craftingmaterials_tags_idx;
+DROP INDEX IF EXISTS craftingmaterials_category_id_idx;
+ALTER TABLE craftingmaterials DROP COLUMN IF EXISTS tags;
+ALTER TABLE craftingmaterials DROP COLUMN IF EXISTS category_id;
+DROP TABLE IF EXISTS categories;
\ No newline at end of file
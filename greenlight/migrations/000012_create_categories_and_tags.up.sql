@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    parent_id bigint REFERENCES categories ON DELETE RESTRICT,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT categories_parent_check CHECK (parent_id <> id)
+);
+
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories (parent_id);
+
+ALTER TABLE craftingmaterials ADD COLUMN IF NOT EXISTS category_id bigint REFERENCES categories ON DELETE RESTRICT;
+ALTER TABLE craftingmaterials ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS craftingmaterials_category_id_idx ON craftingmaterials (category_id);
+CREATE INDEX IF NOT EXISTS craftingmaterials_tags_idx ON craftingmaterials USING GIN (tags);
\ No newline at end of file
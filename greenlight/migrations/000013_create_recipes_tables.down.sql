@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code IN ('recipes:read', 'recipes:write');
+DROP TABLE IF EXISTS recipe_subrecipes;
+DROP TABLE IF EXISTS recipe_materials;
+DROP TABLE IF EXISTS recipes;
\ No newline at end of file
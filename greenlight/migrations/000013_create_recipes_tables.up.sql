@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS recipes (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS recipe_materials (
+    recipe_id bigint NOT NULL REFERENCES recipes ON DELETE CASCADE,
+    crafting_material_id bigint NOT NULL REFERENCES craftingmaterials ON DELETE RESTRICT,
+    quantity bigint NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (recipe_id, crafting_material_id)
+);
+
+CREATE TABLE IF NOT EXISTS recipe_subrecipes (
+    recipe_id bigint NOT NULL REFERENCES recipes ON DELETE CASCADE,
+    sub_recipe_id bigint NOT NULL REFERENCES recipes ON DELETE RESTRICT,
+    quantity bigint NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (recipe_id, sub_recipe_id),
+    CONSTRAINT recipe_subrecipes_self_check CHECK (recipe_id <> sub_recipe_id)
+);
+
+CREATE INDEX IF NOT EXISTS recipe_materials_crafting_material_id_idx ON recipe_materials (crafting_material_id);
+CREATE INDEX IF NOT EXISTS recipe_subrecipes_sub_recipe_id_idx ON recipe_subrecipes (sub_recipe_id);
+
+INSERT INTO permissions (code)
+VALUES ('recipes:read'), ('recipes:write');
+
+-- Everyone who can read crafting materials can read the recipes made from them.
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT up.user_id, (SELECT id FROM permissions WHERE code = 'recipes:read')
+FROM users_permissions up
+INNER JOIN permissions p ON p.id = up.permission_id
+WHERE p.code = 'craftingmaterials:read'
+ON CONFLICT DO NOTHING;
\ No newline at end of file
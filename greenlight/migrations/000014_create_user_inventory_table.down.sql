@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'inventory:write';
+DROP TABLE IF EXISTS user_inventory;
\ No newline at end of file
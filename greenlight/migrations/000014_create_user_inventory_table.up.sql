@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS user_inventory (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    crafting_material_id bigint NOT NULL REFERENCES craftingmaterials ON DELETE CASCADE,
+    quantity bigint NOT NULL,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, crafting_material_id),
+    CONSTRAINT user_inventory_quantity_check CHECK (quantity >= 0)
+);
+
+INSERT INTO permissions (code)
+VALUES ('inventory:write');
+
+-- Everyone who can read crafting materials can keep an inventory of them.
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT up.user_id, (SELECT id FROM permissions WHERE code = 'inventory:write')
+FROM users_permissions up
+INNER JOIN permissions p ON p.id = up.permission_id
+WHERE p.code = 'craftingmaterials:read'
+ON CONFLICT DO NOTHING;
\ No newline at end of file
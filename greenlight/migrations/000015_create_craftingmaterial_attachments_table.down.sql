@@ -0,0 +1 @@
+DROP TABLE IF EXISTS craftingmaterial_attachments;
\ No newline at end of file
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS craftingmaterial_attachments (
+    id bigserial PRIMARY KEY,
+    crafting_material_id bigint NOT NULL REFERENCES craftingmaterials ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    filename text NOT NULL,
+    content_type text NOT NULL,
+    size bigint NOT NULL,
+    storage_key text NOT NULL,
+    thumbnail_key text
+);
+
+CREATE INDEX IF NOT EXISTS craftingmaterial_attachments_crafting_material_id_idx ON craftingmaterial_attachments (crafting_material_id);
\ No newline at end of file
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS tokens_family_id_idx;
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS family_id;
+DROP TABLE IF EXISTS token_families;
\ No newline at end of file
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS token_families (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_agent text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS token_families_user_id_idx ON token_families (user_id);
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family_id bigint REFERENCES token_families ON DELETE CASCADE;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_family_id_idx ON tokens (family_id);
\ No newline at end of file
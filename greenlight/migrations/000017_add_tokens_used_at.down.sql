@@ -0,0 +1 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS used_at;
\ No newline at end of file
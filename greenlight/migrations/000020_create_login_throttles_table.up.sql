@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS login_throttles (
+    scope text NOT NULL,
+    key text NOT NULL,
+    failures integer NOT NULL DEFAULT 0,
+    last_failed_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp with time zone,
+    PRIMARY KEY (scope, key)
+);
+
+INSERT INTO permissions (code)
+VALUES ('users:admin');
\ No newline at end of file